@@ -86,13 +86,52 @@ stats_display.cfgvalue = function(self, section)
     local cache_pass  = stats["cache_hit_pass"] or "0"
     local cache_ratio = stats["total_cache_ratio"] or "0.00"
 
+    -- 第四行：TLS
+    local tls_conns   = stats["tls_connections"] or "0"
+
+    -- 第五行：协程池 (仅协程池模式)
+    local pool_line = ""
+    if stats["pool_workers"] then
+        pool_line = string.format(
+            "<br><b>协程池:</b> %s/%s 忙碌 | <b>排队:</b> %s | <b>平均等待:</b> %s ms | <b>溢出:</b> %s | <b>拒绝:</b> %s",
+            stats["pool_busy"] or "0", stats["pool_workers"], stats["pool_queue"] or "0",
+            stats["pool_wait_avg_ms"] or "0.00", stats["pool_overflow"] or "0", stats["pool_rejected"] or "0")
+    end
+
+    -- 审计模式
+    if stats["audit_would_modify"] then
+        pool_line = pool_line .. string.format(
+            "<br><b>审计:</b> 本应修改 %s | 本应断开 %s | 本应卸载 %s",
+            stats["audit_would_modify"], stats["audit_would_drop"] or "0", stats["audit_would_offload"] or "0")
+    end
+
+    -- 正则匹配超时 (regexp2)
+    if (tonumber(stats["regex_timeouts"]) or 0) > 0 then
+        pool_line = pool_line .. "<br><b>正则超时:</b> " .. stats["regex_timeouts"]
+    end
+
+    -- 第六行：自动学习的白名单
+    local learned = {}
+    for key, _ in pairs(stats) do
+        local host = key:match("^learned%.(.+)$")
+        if host then
+            learned[#learned + 1] = host
+        end
+    end
+    if #learned > 0 then
+        table.sort(learned)
+        pool_line = pool_line .. "<br><b>自动白名单:</b> " .. table.concat(learned, ", ")
+    end
+
     return string.format(
         "<b>当前连接:</b> %s | <b>请求总数:</b> %s | <b>处理速率:</b> %s RPS<br>" ..
         "<b>成功修改:</b> %s | <b>直接放行:</b> %s | <b>规则处理:</b> %s<br>" ..
-        "<b>缓存(修改):</b> %s | <b>缓存(放行):</b> %s | <b>总缓存率:</b> %s%%",
+        "<b>缓存(修改):</b> %s | <b>缓存(放行):</b> %s | <b>总缓存率:</b> %s%%<br>" ..
+        "<b>TLS 连接:</b> %s%s",
         connections, total_reqs, rps,
         modified, passthrough, rule_proc,
-        cache_mod, cache_pass, cache_ratio
+        cache_mod, cache_pass, cache_ratio,
+        tls_conns, pool_line
     )
 end
 
@@ -129,6 +168,41 @@ pool_size.datatype = "uinteger"
 pool_size.default = "0"
 pool_size.description = "工作协程池的大小。设为 0 则每个连接创建协程，使用协程池会限制最大并发，但能减少 GC。<br>最大 RAM 估计：pool_size*(2*buffer_size) + cache_ram。<br>若 pool_size 设为 0，则最大 RAM 估计：连接数*(2*buffer_size) + cache_ram。"
 
+listeners = main:taboption("general", Value, "listeners", "监听器数量")
+listeners:depends("operating_profile", "custom")
+listeners.datatype = "uinteger"
+listeners.default = "0"
+listeners.description = "使用 SO_REUSEPORT 在同一端口上创建多个监听器，每个监听器拥有独立的 Accept 循环。设为 0 则与 CPU 核心数相同。"
+
+shard_pool = main:taboption("general", Flag, "shard_pool", "按监听器拆分协程池")
+shard_pool:depends("operating_profile", "custom")
+shard_pool.default = 0
+shard_pool.description = "启用后，工作协程池按监听器平均拆分，每个监听器只向自己的 worker 子集分发连接。"
+
+pool_min = main:taboption("general", Value, "pool_min", "协程池最小值")
+pool_min:depends("operating_profile", "custom")
+pool_min.datatype = "uinteger"
+pool_min.placeholder = "与协程池大小相同"
+pool_min.description = "空闲时协程池最多缩减到的 worker 数，留空则与协程池大小相同。"
+
+pool_max = main:taboption("general", Value, "pool_max", "协程池最大值")
+pool_max:depends("operating_profile", "custom")
+pool_max.datatype = "uinteger"
+pool_max.placeholder = "与协程池大小相同"
+pool_max.description = "连接排队时协程池最多扩展到的 worker 数，留空则不自动扩容。"
+
+pool_wait = main:taboption("general", Value, "pool_wait", "最长排队时间 (毫秒)")
+pool_wait:depends("operating_profile", "custom")
+pool_wait.datatype = "uinteger"
+pool_wait.placeholder = "0"
+pool_wait.description = "连接在协程池队列中等待超过该时间后按溢出策略处理，留空或 0 则一直等待。"
+
+pool_overflow = main:taboption("general", ListValue, "pool_overflow", "溢出策略")
+pool_overflow:depends("operating_profile", "custom")
+pool_overflow:value("goroutine", "交给临时协程处理")
+pool_overflow:value("reject", "拒绝连接 (RST)")
+pool_overflow.default = "goroutine"
+
 cache_size = main:taboption("general", Value, "cache_size", "LRU 缓存大小")
 cache_size:depends("operating_profile", "custom")
 cache_size.datatype = "uinteger"
@@ -143,7 +217,7 @@ gogc_value.description = "Go 语言的垃圾回收参数（默认 100）。<b>
 
 ua = main:taboption("general", Value, "ua", "User-Agent 标识")
 ua.default = "FFF"
-ua.description = "用于替换的 User-Agent 字符串。"
+ua.description = "用于替换的 User-Agent 字符串。可使用占位符 {os} {os_version} {device} {browser} {browser_version} {engine}，取自原 UA 的解析结果。"
 
 -- 重构：匹配规则
 match_mode = main:taboption("general", ListValue, "match_mode", "匹配规则",
@@ -157,7 +231,19 @@ match_mode.default = "keywords"
 keywords = main:taboption("general", Value, "keywords", "关键词列表")
 keywords:depends("match_mode", "keywords")
 keywords.default = "Windows,Linux,Android,iPhone,Macintosh,iPad,OpenHarmony"
-keywords.description = "当 UA 包含列表中的任意关键词时，替换整个 UA 为目标值。用逗号分隔。"
+keywords.description = "当 UA 包含列表中的任意关键词时，替换整个 UA 为目标值。用逗号分隔。<br>" ..
+    "可写作 <code>关键词=替换 UA</code> 为该关键词指定专属的替换 UA，多个关键词同时命中时取列表中最靠前的；替换 UA 含逗号时只能写在关键词文件中。"
+
+keywords_file = main:taboption("general", Value, "keywords_file", "关键词文件")
+keywords_file:depends("match_mode", "keywords")
+keywords_file.placeholder = "/etc/UAmask/keywords"
+keywords_file.description = "额外的关键词，每行一个，适合大量关键词；同样支持 <code>关键词=替换 UA</code>。"
+
+keywords_ignore_case = main:taboption("general", Flag, "keywords_ignore_case", "忽略大小写")
+keywords_ignore_case.description = "关键词与防火墙 UA 关键词白名单匹配时忽略英文大小写（如 iphone 可匹配 iPhone）。"
+
+keywords_whole_word = main:taboption("general", Flag, "keywords_whole_word", "整词匹配")
+keywords_whole_word.description = "关键词两端不能与其他字母数字相连（如 Mac 不匹配 Macintosh）。"
 
 -- 仅在 regex 模式下显示
 ua_regex = main:taboption("general", Value, "ua_regex", "正则表达式")
@@ -173,9 +259,66 @@ replace_method:value("partial", "部分替换（仅替换匹配内容）")
 replace_method.default = "full"
 replace_method.description = "<b>完整替换：</b> 将整个 UA 替换为新值。<br><b>部分替换：</b> 仅将 UA 中被正则匹配到的部分替换为新值。"
 
+regex_engine = main:taboption("general", ListValue, "regex_engine", "正则引擎")
+regex_engine:value("re2", "RE2（线性时间）")
+regex_engine:value("regexp2", "regexp2（支持环视、反向引用）")
+regex_engine.default = "re2"
+regex_engine.description = "regexp2 支持 <code>Windows(?!.*Xbox)</code>、<code>Android(?! TV)</code> 等写法，单次匹配超时后本次不修改 UA、不缓存结果，并计入运行统计。同时用于规则文件中的 ua-regex。部分替换中的 <code>$1</code>、<code>${name}</code> 在两种引擎下含义相同（按 Go regexp 的规则，如 <code>$1x</code> 表示名为 1x 的分组，需写作 <code>${1}x</code>）。"
+
+regex_timeout = main:taboption("general", Value, "regex_timeout", "正则匹配超时（毫秒）")
+regex_timeout:depends("regex_engine", "regexp2")
+regex_timeout.datatype = "uinteger"
+regex_timeout.default = 100
+
+audit = main:taboption("general", Flag, "audit", "审计模式")
+audit.description = "只观察不修改：照常执行匹配、规则与防火墙决策，但所有请求原样转发、不写入防火墙 set。<br>" ..
+    "本应修改、断开与卸载的请求记录在应用日志与运行统计中，适合在新的关键词或规则上线前用真实流量检验。"
+
+client_hints = main:taboption("general", ListValue, "client_hints", "Client Hints 处理")
+client_hints:value("off", "不处理")
+client_hints:value("rewrite", "按替换 UA 重写")
+client_hints:value("remove", "删除")
+client_hints.default = "off"
+client_hints.description = "Chromium 浏览器会在 Sec-CH-UA、Sec-CH-UA-Platform 等请求头中透露真实平台。修改 UA 时可按替换 UA 重写这些头（替换 UA 不是 Chromium 时删除），或直接删除。"
+
+learn_whitelist = main:taboption("general", Flag, "learn_whitelist", "自动学习白名单")
+learn_whitelist.description = "某个网站连续以 403/406 拒绝修改过 UA 的请求（而未修改的请求正常）时，暂时停止修改该网站的 UA。<br>" ..
+    "学习到的网站显示在运行统计中，可通过控制接口 <code>DELETE /learned?host=域名</code> 撤销。"
+
+learn_threshold = main:taboption("general", Value, "learn_threshold", "连续拒绝次数")
+learn_threshold:depends("learn_whitelist", "1")
+learn_threshold.datatype = "min(1)"
+learn_threshold.default = 3
+
+learn_ttl = main:taboption("general", Value, "learn_ttl", "白名单有效期（分钟）")
+learn_ttl:depends("learn_whitelist", "1")
+learn_ttl.datatype = "min(1)"
+learn_ttl.default = 60
+
 whitelist = main:taboption("general", Value, "whitelist", "User-Agent 白名单")
 whitelist.placeholder = ""
-whitelist.description = "指定不进行替换的 User-Agent，用逗号分隔（如：MicroMessenger Client,ByteDancePcdn）。"
+whitelist.description = "指定不进行替换的 User-Agent，用逗号分隔（如：MicroMessenger Client,ByteDancePcdn）。<br>" ..
+    "默认完全相同才匹配，可加前缀：<code>prefix:</code> 开头、<code>contains:</code> 包含、<code>glob:</code> 通配符（* ?）、<code>regex:</code> 正则，" ..
+    "如 <code>prefix:Mozilla/5.0 (PlayStation</code>。"
+
+deep_scan_ports = main:taboption("general", Value, "deep_scan_ports", "深度扫描端口")
+deep_scan_ports.placeholder = "8000 9000"
+deep_scan_ports.description = "对这些目标端口上的非 HTTP 流量逐字节查找 User-Agent: 行，并用等长（补空格）的值原地替换，用空格分隔。<br>" ..
+    "适用于二进制前导数据后跟 HTTP 风格头部的私有协议。深度扫描端口的流量不会被卸载。"
+
+rules_file = main:taboption("general", Value, "rules_file", "规则文件")
+rules_file.placeholder = "/etc/UAmask/rules"
+rules_file.description = "按顺序匹配的规则，每行一条，第一条命中的规则生效，优先于白名单与匹配模式。<br>" ..
+    "条件：ua= ua-regex= host= dst= dport= src= os= os-version= device= browser= browser-version= engine=（用 != 取反），动作：replace [\"新 UA\"] / pass / offload / drop。<br>" ..
+    "例：<code>ua=Android host!=*.campus.edu replace</code>"
+
+host_map_file = main:taboption("general", Value, "host_map_file", "Host UA 映射文件")
+host_map_file.placeholder = "/etc/UAmask/host_map"
+host_map_file.description = "按请求的 Host 选择替换 UA，每行 <code>域名 \"UA\"</code> 或 <code>域名 pass</code>（不修改）。<br>" ..
+    "example.com 匹配自身及子域名，*.example.com 仅匹配子域名，多项命中时最长的域名生效；未命中时使用上方的 User-Agent。"
+
+ua_stats = main:taboption("general", Flag, "ua_stats", "UA 分类统计")
+ua_stats.description = "解析每个请求的 UA，按系统、设备类型与浏览器计数并写入统计文件（ua_os.* / ua_device.* / ua_browser.*）。"
 
 -- === Tab 2: 网络与防火墙（网络、日志等级、防火墙相关）===
 
@@ -200,6 +343,23 @@ Firewall_ua_whitelist:depends("enable_firewall_set", "1")
 Firewall_ua_whitelist.placeholder = ""
 Firewall_ua_whitelist.description = "指定不通过 UAmask 代理的 UA 关键词（流量卸载），用逗号分隔（如：Valve/Steam,360pcdn）。"
 
+Firewall_sni_allow = main:taboption("network", Value, "Firewall_sni_allow", "TLS SNI 卸载名单")
+Firewall_sni_allow:depends("enable_firewall_set", "1")
+Firewall_sni_allow.placeholder = ""
+Firewall_sni_allow.description = "TLS 连接的 SNI 命中这些域名（含子域名）时立即卸载，用逗号分隔（如：steamserver.net,googlevideo.com）。"
+
+Firewall_sni_deny = main:taboption("network", Value, "Firewall_sni_deny", "TLS SNI 保留名单")
+Firewall_sni_deny:depends("enable_firewall_set", "1")
+Firewall_sni_deny.placeholder = ""
+Firewall_sni_deny.description = "TLS 连接的 SNI 命中这些域名（含子域名）时永不卸载，用逗号分隔。"
+
+proto_policy = main:taboption("network", Value, "proto_policy", "协议卸载策略")
+proto_policy:depends("Firewall_ua_bypass", "1")
+proto_policy.placeholder = "bittorrent=offload,unknown=never"
+proto_policy.description = "按协议指定非 HTTP 流量的卸载策略，用逗号分隔。<br>" ..
+    "协议：tls, ssh, bittorrent, rtmp, mqtt, smtp, imap, websocket, unknown<br>" ..
+    "策略：<b>score</b>（计分决策，默认）、<b>offload</b>（立即卸载）、<b>never</b>（永不卸载）"
+
 Firewall_drop_on_match=main:taboption("network", Flag, "Firewall_drop_on_match", "匹配时断开连接")
 Firewall_drop_on_match:depends("enable_firewall_set", "1")
 Firewall_drop_on_match.description = "启用后，当流量匹配 UA 白名单规则时，将直接断开连接，强制其重新建立连接绕过 UAmask。"
@@ -243,6 +403,11 @@ firewall_timeout.datatype = "uinteger"
 firewall_timeout.default = 28800
 firewall_timeout.description = "添加到 ipset/nfset 中的规则的超时时间。单位为秒（默认8*3600）。"
 
+drain_timeout = main:taboption("advanced", Value, "drain_timeout", "停止等待时间（秒）")
+drain_timeout.datatype = "uinteger"
+drain_timeout.default = 10
+drain_timeout.description = "停止或重启服务时，等待进行中的连接（如下载）自然结束的最长时间，超时后强制关闭。"
+
 
 -- === Tab 4: 应用日志 ===
 
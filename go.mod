@@ -10,6 +10,6 @@ require (
 require github.com/hashicorp/golang-lru/v2 v2.0.7
 
 require (
-	github.com/dlclark/regexp2 v1.11.5 // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
+	github.com/dlclark/regexp2 v1.11.5
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
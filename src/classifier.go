@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Protocol 表示连接首包识别出的协议
+type Protocol string
+
+const (
+	ProtoHTTP       Protocol = "http"
+	ProtoRTSP       Protocol = "rtsp"
+	ProtoSIP        Protocol = "sip"
+	ProtoTLS        Protocol = "tls"
+	ProtoSSH        Protocol = "ssh"
+	ProtoBitTorrent Protocol = "bittorrent"
+	ProtoRTMP       Protocol = "rtmp"
+	ProtoMQTT       Protocol = "mqtt"
+	ProtoSMTP       Protocol = "smtp"
+	ProtoIMAP       Protocol = "imap"
+	ProtoWebSocket  Protocol = "websocket"
+	ProtoUnknown    Protocol = "unknown"
+)
+
+var (
+	HTTP_METHOD = []string{
+		"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "TRACE", "CONNECT", "PATCH",
+		// WebDAV / CalDAV / DeltaV
+		"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+		"SEARCH", "REPORT", "MKCALENDAR", "MKACTIVITY", "CHECKOUT", "MERGE",
+		"ACL", "BIND", "UNBIND", "REBIND", "ORDERPATCH", "MKWORKSPACE",
+	}
+
+	RTSP_METHOD = []string{
+		"OPTIONS", "DESCRIBE", "ANNOUNCE", "SETUP", "PLAY", "PAUSE", "TEARDOWN",
+		"GET_PARAMETER", "SET_PARAMETER", "REDIRECT", "RECORD",
+	}
+
+	SIP_METHOD = []string{
+		"REGISTER", "INVITE", "ACK", "BYE", "CANCEL", "OPTIONS", "SUBSCRIBE", "NOTIFY",
+		"MESSAGE", "INFO", "PRACK", "UPDATE", "REFER", "PUBLISH",
+	}
+
+	imapCommands = []string{"CAPABILITY", "LOGIN", "AUTHENTICATE", "STARTTLS", "ID", "NOOP"}
+
+	bitTorrentHandshake = []byte("\x13BitTorrent protocol")
+)
+
+// classifyHintLen 分类时最多窥视的字节数
+const classifyHintLen = 24
+
+// classifyWait 是分类器需要更多字节时的最长等待时间，超时后按已缓冲的数据分类
+// 客户端先发的短消息 (如单字节心跳) 不会因此一直等到服务器超时；
+// 已缓冲的数据是请求方法的前缀时不限时，与解析请求头一样阻塞等待
+const classifyWait = 200 * time.Millisecond
+
+type matchResult int
+
+const (
+	matchNo   matchResult = iota // 不是该协议
+	matchYes                     // 确定是该协议
+	matchMore                    // 数据不足，需要更多字节
+)
+
+// protocolClassifier 根据首包字节判断协议
+type protocolClassifier struct {
+	proto Protocol
+	match func(hint []byte) matchResult
+}
+
+// protocolClassifiers 按顺序尝试，第一个命中的生效
+var protocolClassifiers = []protocolClassifier{
+	{ProtoHTTP, matchTextRequest},
+	{ProtoTLS, matchTLS},
+	{ProtoSSH, matchPrefix([]byte("SSH-"))},
+	{ProtoBitTorrent, matchPrefix(bitTorrentHandshake)},
+	{ProtoMQTT, matchMQTT},
+	{ProtoSMTP, matchSMTP},
+	{ProtoIMAP, matchIMAP},
+	{ProtoRTMP, matchRTMP},
+	{ProtoWebSocket, matchWebSocketFrame},
+}
+
+// classifyProtocol 窥视 reader 缓冲区中的首包并识别协议，不消费数据
+// conn 为 reader 的数据来源，用于限制等待更多字节的时间 (为 nil 时不限制)
+func classifyProtocol(reader *bufio.Reader, conn net.Conn) (Protocol, error) {
+	// 至少等待 1 个字节
+	if _, err := reader.Peek(1); err != nil {
+		return ProtoUnknown, err
+	}
+	waited := false
+	defer func() {
+		if waited {
+			conn.SetReadDeadline(time.Time{})
+		}
+	}()
+	for {
+		n := reader.Buffered()
+		if n > classifyHintLen {
+			n = classifyHintLen
+		}
+		hint, _ := reader.Peek(n)
+
+		needMore, textMore := false, false
+		for _, c := range protocolClassifiers {
+			switch c.match(hint) {
+			case matchYes:
+				if c.proto == ProtoHTTP {
+					return textRequestProtocol(reader), nil
+				}
+				return c.proto, nil
+			case matchMore:
+				needMore = true
+				textMore = textMore || c.proto == ProtoHTTP
+			}
+		}
+		if !needMore || n >= classifyHintLen {
+			return ProtoUnknown, nil
+		}
+		// 某些分类器需要更多字节，等待下一个字节；缓慢发送的请求方法不限时，
+		// 避免有效的 HTTP 请求被判为未知协议而原样转发甚至卸载
+		switch {
+		case conn == nil:
+		case textMore && waited:
+			waited = false
+			conn.SetReadDeadline(time.Time{})
+		case !textMore && !waited:
+			waited = true
+			conn.SetReadDeadline(time.Now().Add(classifyWait))
+		}
+		if _, err := reader.Peek(n + 1); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && reader.Buffered() > n {
+				// 超时前恰好有数据到达，继续分类
+				continue
+			}
+			// 超时或连接出错：已缓冲的数据不足以确定协议
+			return ProtoUnknown, nil
+		}
+	}
+}
+
+// matchPrefix 返回一个前缀匹配的分类函数
+func matchPrefix(prefix []byte) func([]byte) matchResult {
+	return func(hint []byte) matchResult {
+		if len(hint) >= len(prefix) {
+			if bytes.HasPrefix(hint, prefix) {
+				return matchYes
+			}
+			return matchNo
+		}
+		if bytes.HasPrefix(prefix, hint) {
+			return matchMore
+		}
+		return matchNo
+	}
+}
+
+// matchToken 判断 hint 是否以 "<token> " 开头
+func matchToken(hint []byte, tokens []string, foldCase bool) matchResult {
+	result := matchNo
+	for _, token := range tokens {
+		want := token + " "
+		n := len(want)
+		if len(hint) < n {
+			n = len(hint)
+		}
+		got := string(hint[:n])
+		var ok bool
+		if foldCase {
+			ok = strings.EqualFold(got, want[:n])
+		} else {
+			ok = got == want[:n]
+		}
+		if !ok {
+			continue
+		}
+		if n == len(want) {
+			return matchYes
+		}
+		result = matchMore
+	}
+	return result
+}
+
+// matchTextRequest 识别以 HTTP/RTSP/SIP 方法开头的文本请求
+func matchTextRequest(hint []byte) matchResult {
+	result := matchNo
+	for _, methods := range [][]string{HTTP_METHOD, RTSP_METHOD, SIP_METHOD} {
+		switch matchToken(hint, methods, false) {
+		case matchYes:
+			return matchYes
+		case matchMore:
+			result = matchMore
+		}
+	}
+	return result
+}
+
+// textRequestProtocol 根据请求行末尾的版本号区分 HTTP、RTSP 与 SIP
+// 请求行超出缓冲区或无法读取时按 HTTP 处理
+func textRequestProtocol(reader *bufio.Reader) Protocol {
+	line, err := peekUntil(reader, []byte("\n"))
+	if err != nil {
+		return ProtoHTTP
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	sp := bytes.LastIndexByte(line, ' ')
+	if sp < 0 {
+		return ProtoHTTP
+	}
+	version := line[sp+1:]
+	switch {
+	case bytes.HasPrefix(version, []byte("RTSP/")):
+		return ProtoRTSP
+	case bytes.HasPrefix(version, []byte("SIP/")):
+		return ProtoSIP
+	}
+	return ProtoHTTP
+}
+
+// peekUntil 在不消费数据的前提下窥视直到 delim 出现，返回包含 delim 的数据
+// 缓冲区已满仍未出现时返回 bufio.ErrBufferFull
+func peekUntil(reader *bufio.Reader, delim []byte) ([]byte, error) {
+	return peekUntilFunc(reader, func(buf []byte) int {
+		if i := bytes.Index(buf, delim); i >= 0 {
+			return i + len(delim)
+		}
+		return -1
+	})
+}
+
+// peekUntilFunc 与 peekUntil 相同，由 find 返回结束位置 (不存在时返回 -1)
+func peekUntilFunc(reader *bufio.Reader, find func([]byte) int) ([]byte, error) {
+	n := reader.Buffered()
+	if n == 0 {
+		n = 1
+	}
+	for {
+		buf, err := reader.Peek(n)
+		if end := find(buf); end >= 0 {
+			return buf[:end], nil
+		}
+		if err != nil {
+			return buf, err
+		}
+		if n >= reader.Size() {
+			return buf, bufio.ErrBufferFull
+		}
+		// 阻塞等待更多数据
+		n = reader.Buffered()
+		if n <= len(buf) {
+			n = len(buf) + 1
+		}
+	}
+}
+
+func matchTLS(hint []byte) matchResult {
+	if len(hint) < 3 {
+		if len(hint) == 0 || hint[0] != tlsRecordTypeHandshake {
+			return matchNo
+		}
+		return matchMore
+	}
+	if looksLikeTLS(hint) {
+		return matchYes
+	}
+	return matchNo
+}
+
+// matchMQTT 识别 MQTT CONNECT 报文 (协议名 MQTT 或 MQIsdp)
+func matchMQTT(hint []byte) matchResult {
+	if len(hint) == 0 || hint[0] != 0x10 {
+		return matchNo
+	}
+	// 剩余长度使用 1~4 字节变长编码
+	i := 1
+	for ; i < len(hint) && i <= 4; i++ {
+		if hint[i]&0x80 == 0 {
+			break
+		}
+	}
+	if i >= len(hint) {
+		return matchMore
+	}
+	name := hint[i+1:]
+	for _, want := range [][]byte{[]byte("\x00\x04MQTT"), []byte("\x00\x06MQIsdp")} {
+		if len(name) >= len(want) {
+			if bytes.HasPrefix(name, want) {
+				return matchYes
+			}
+		} else if bytes.HasPrefix(want, name) {
+			return matchMore
+		}
+	}
+	return matchNo
+}
+
+// matchSMTP 识别客户端发出的 SMTP/LMTP 问候命令
+func matchSMTP(hint []byte) matchResult {
+	return matchToken(hint, []string{"EHLO", "HELO", "LHLO"}, true)
+}
+
+// matchIMAP 识别 "<tag> <command>" 形式的 IMAP 客户端命令
+func matchIMAP(hint []byte) matchResult {
+	sp := bytes.IndexByte(hint, ' ')
+	if sp < 0 {
+		if len(hint) <= 10 && isIMAPTag(hint) {
+			return matchMore
+		}
+		return matchNo
+	}
+	if sp == 0 || sp > 10 || !isIMAPTag(hint[:sp]) {
+		return matchNo
+	}
+	rest := hint[sp+1:]
+	result := matchNo
+	for _, cmd := range imapCommands {
+		n := len(cmd)
+		if len(rest) < n {
+			if strings.EqualFold(string(rest), cmd[:len(rest)]) {
+				result = matchMore
+			}
+			continue
+		}
+		if !strings.EqualFold(string(rest[:n]), cmd) {
+			continue
+		}
+		if len(rest) == n {
+			result = matchMore
+			continue
+		}
+		if c := rest[n]; c == ' ' || c == '\r' {
+			return matchYes
+		}
+	}
+	return result
+}
+
+func isIMAPTag(tag []byte) bool {
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRTMP 识别 RTMP 简单握手: C0 版本号 0x03，C1 的 zero 字段为 0
+func matchRTMP(hint []byte) matchResult {
+	if len(hint) == 0 || hint[0] != 0x03 {
+		return matchNo
+	}
+	if len(hint) < 9 {
+		return matchMore
+	}
+	if bytes.Equal(hint[5:9], []byte{0, 0, 0, 0}) {
+		return matchYes
+	}
+	return matchNo
+}
+
+// matchWebSocketFrame 识别客户端发出的首个 WebSocket 帧 (RFC 6455 5.2)：
+// 无 RSV 位、不是延续帧、控制帧不分片且不超过 125 字节、已掩码、扩展长度使用最短编码，
+// 需要完整的帧头 (含掩码键) 才会判定
+func matchWebSocketFrame(hint []byte) matchResult {
+	if len(hint) == 0 {
+		return matchNo
+	}
+	b0 := hint[0]
+	opcode := b0 & 0x0f
+	if b0&0x70 != 0 {
+		return matchNo
+	}
+	switch opcode {
+	case 0x1, 0x2:
+	case 0x8, 0x9, 0xa:
+		if b0&0x80 == 0 {
+			return matchNo
+		}
+	default:
+		return matchNo
+	}
+	if len(hint) < 2 {
+		return matchMore
+	}
+	b1 := hint[1]
+	if b1&0x80 == 0 {
+		return matchNo
+	}
+	payloadLen := b1 & 0x7f
+	extLen := 0
+	switch {
+	case opcode >= 0x8 && payloadLen > 125:
+		return matchNo
+	case payloadLen == 126:
+		extLen = 2
+	case payloadLen == 127:
+		extLen = 8
+	}
+	if len(hint) < 2+extLen+4 {
+		return matchMore
+	}
+	switch extLen {
+	case 2:
+		if uint16(hint[2])<<8|uint16(hint[3]) < 126 {
+			return matchNo
+		}
+	case 8:
+		// 最高位必须为 0，且长度至少为 65536
+		if hint[2]&0x80 != 0 || bytes.Equal(hint[2:8], make([]byte, 6)) {
+			return matchNo
+		}
+	}
+	return matchYes
+}
+
+// 协议卸载策略
+const (
+	PolicyScore   = "score"   // 按非 HTTP 事件计分 (默认)
+	PolicyOffload = "offload" // 立即卸载
+	PolicyNever   = "never"   // 永不卸载
+)
+
+// parseProtocolPolicies 解析 "bittorrent=offload,unknown=never" 形式的协议策略
+func parseProtocolPolicies(arg string) (map[Protocol]string, error) {
+	policies := make(map[Protocol]string)
+	for _, item := range strings.Split(arg, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, policy, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid protocol policy %q (want proto=policy)", item)
+		}
+		proto := Protocol(strings.ToLower(strings.TrimSpace(name)))
+		if !isKnownProtocol(proto) || proto == ProtoHTTP {
+			return nil, fmt.Errorf("unknown protocol in policy: %q", name)
+		}
+		policy = strings.ToLower(strings.TrimSpace(policy))
+		switch policy {
+		case PolicyScore, PolicyOffload, PolicyNever:
+		default:
+			return nil, fmt.Errorf("unknown policy %q for protocol %s", policy, proto)
+		}
+		policies[proto] = policy
+	}
+	return policies, nil
+}
+
+func isKnownProtocol(proto Protocol) bool {
+	if proto == ProtoUnknown {
+		return true
+	}
+	for _, c := range protocolClassifiers {
+		if c.proto == proto {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyProtocol(t *testing.T) {
+	mqtt := []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c}
+	rtmp := append([]byte{0x03, 1, 2, 3, 4, 0, 0, 0, 0}, bytes.Repeat([]byte{0xaa}, 32)...)
+	wsFrame := []byte{0x81, 0x85, 1, 2, 3, 4, 'h', 'e', 'l', 'l', 'o'}
+	tests := []struct {
+		name string
+		data []byte
+		want Protocol
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), ProtoHTTP},
+		{"http webdav", []byte("PROPFIND /dav HTTP/1.1\r\n"), ProtoHTTP},
+		{"http request line beyond buffer", []byte("GET /" + strings.Repeat("a", 64)), ProtoHTTP},
+		{"rtsp", []byte("OPTIONS rtsp://cam/ RTSP/1.0\r\nCSeq: 1\r\n\r\n"), ProtoRTSP},
+		{"sip", []byte("INVITE sip:a@b SIP/2.0\r\n"), ProtoSIP},
+		{"sip options", []byte("OPTIONS sip:a@b SIP/2.0\r\n"), ProtoSIP},
+		{"tls", buildClientHello(sniExtension("a.test")), ProtoTLS},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.6\r\n"), ProtoSSH},
+		{"bittorrent", append(append([]byte(nil), bitTorrentHandshake...), make([]byte, 8)...), ProtoBitTorrent},
+		{"mqtt", mqtt, ProtoMQTT},
+		{"smtp", []byte("EHLO mail.example.com\r\n"), ProtoSMTP},
+		{"smtp lower case", []byte("helo x\r\n"), ProtoSMTP},
+		{"imap", []byte("a1 LOGIN user pass\r\n"), ProtoIMAP},
+		{"rtmp", rtmp, ProtoRTMP},
+		{"websocket", wsFrame, ProtoWebSocket},
+		{"lower case method", []byte("get / HTTP/1.1\r\n"), ProtoUnknown},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03}, ProtoUnknown},
+		{"truncated method", []byte("GE"), ProtoUnknown},
+		{"truncated tls header", []byte{0x16, 0x03}, ProtoUnknown},
+		{"truncated websocket header", wsFrame[:4], ProtoUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 数据在结尾处截止：需要更多字节的分类器遇到 EOF 后按未知处理
+			reader := bufio.NewReaderSize(bytes.NewReader(tt.data), 32)
+			got, err := classifyProtocol(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if reader.Buffered() == 0 {
+				t.Error("classifyProtocol consumed data")
+			}
+		})
+	}
+}
+
+func TestProtocolMatchers(t *testing.T) {
+	tests := []struct {
+		name  string
+		match func([]byte) matchResult
+		hint  []byte
+		want  matchResult
+	}{
+		{"text method", matchTextRequest, []byte("GET "), matchYes},
+		{"text method prefix", matchTextRequest, []byte("GE"), matchMore},
+		{"text method without space", matchTextRequest, []byte("GET/"), matchNo},
+		{"text rtsp method", matchTextRequest, []byte("TEARDOWN rtsp"), matchYes},
+		{"text shared prefix", matchTextRequest, []byte("P"), matchMore},
+
+		{"tls first byte", matchTLS, []byte{0x16}, matchMore},
+		{"tls header", matchTLS, []byte{0x16, 0x03, 0x01}, matchYes},
+		{"tls bad version", matchTLS, []byte{0x16, 0x03, 0x09}, matchNo},
+		{"tls application data", matchTLS, []byte{0x17, 0x03, 0x03}, matchNo},
+
+		{"mqtt type only", matchMQTT, []byte{0x10}, matchMore},
+		{"mqtt length continues", matchMQTT, []byte{0x10, 0x80}, matchMore},
+		{"mqtt partial name", matchMQTT, []byte{0x10, 0x0c, 0x00, 0x04, 'M'}, matchMore},
+		{"mqtt v3.1 name", matchMQTT, []byte{0x10, 0x0e, 0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p'}, matchYes},
+		{"mqtt wrong name", matchMQTT, []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'X', 'X'}, matchNo},
+		{"mqtt not connect", matchMQTT, []byte{0x20, 0x02}, matchNo},
+
+		{"imap tag only", matchIMAP, []byte("a1"), matchMore},
+		{"imap command prefix", matchIMAP, []byte("a1 LOG"), matchMore},
+		{"imap command without separator", matchIMAP, []byte("a1 LOGIN"), matchMore},
+		{"imap command", matchIMAP, []byte("a1 login "), matchYes},
+		{"imap unknown command", matchIMAP, []byte("a1 FETCH "), matchNo},
+		{"imap tag too long", matchIMAP, []byte("abcdefghijk LOGIN "), matchNo},
+		{"imap invalid tag", matchIMAP, []byte("a*1 LOGIN "), matchNo},
+
+		{"rtmp version only", matchRTMP, []byte{0x03}, matchMore},
+		{"rtmp non-zero field", matchRTMP, []byte{0x03, 0, 0, 0, 0, 1, 0, 0, 0}, matchNo},
+
+		{"ws first byte", matchWebSocketFrame, []byte{0x81}, matchMore},
+		{"ws unmasked", matchWebSocketFrame, []byte{0x81, 0x05}, matchNo},
+		{"ws rsv bits", matchWebSocketFrame, []byte{0xc1, 0x85}, matchNo},
+		{"ws continuation", matchWebSocketFrame, []byte{0x80, 0x85}, matchNo},
+		{"ws fragmented ping", matchWebSocketFrame, []byte{0x09, 0x80}, matchNo},
+		{"ws long ping", matchWebSocketFrame, []byte{0x89, 0xfe}, matchNo},
+		{"ws mask key missing", matchWebSocketFrame, []byte{0x81, 0x85, 1, 2, 3}, matchMore},
+		{"ws 16-bit length", matchWebSocketFrame, []byte{0x82, 0xfe, 0x01, 0x00, 1, 2, 3, 4}, matchYes},
+		{"ws 16-bit length not minimal", matchWebSocketFrame, []byte{0x82, 0xfe, 0x00, 0x10, 1, 2, 3, 4}, matchNo},
+		{"ws 64-bit length not minimal", matchWebSocketFrame, []byte{0x82, 0xff, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4}, matchNo},
+		{"ws 64-bit length high bit", matchWebSocketFrame, []byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 1, 0, 0, 1, 2, 3, 4}, matchNo},
+		{"ws 64-bit length", matchWebSocketFrame, []byte{0x82, 0xff, 0, 0, 0, 0, 0, 1, 0, 0, 1, 2, 3, 4}, matchYes},
+	}
+	for _, tt := range tests {
+		if got := tt.match(tt.hint); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseProtocolPolicies(t *testing.T) {
+	policies, err := parseProtocolPolicies(" BitTorrent=offload, unknown=NEVER ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies[ProtoBitTorrent] != PolicyOffload || policies[ProtoUnknown] != PolicyNever || len(policies) != 2 {
+		t.Errorf("got %v", policies)
+	}
+	for _, arg := range []string{"http=offload", "ftp=offload", "ssh", "ssh=always"} {
+		if _, err := parseProtocolPolicies(arg); err == nil {
+			t.Errorf("%q accepted", arg)
+		}
+	}
+}
+
+func TestClassifyProtocolSlowMethod(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		// 方法前缀分两次发送，间隔超过 classifyWait
+		client.Write([]byte("GE"))
+		time.Sleep(classifyWait + 100*time.Millisecond)
+		client.Write([]byte("T / HTTP/1.1\r\nHost: a\r\n\r\n"))
+		client.Close()
+	}()
+	proto, err := classifyProtocol(bufio.NewReader(server), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != ProtoHTTP {
+		t.Errorf("got %s, want %s", proto, ProtoHTTP)
+	}
+}
+
+func TestClassifyProtocolShortMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go client.Write([]byte{0x16})
+	// 不完整的 TLS 记录头：限时等待后按未知协议处理
+	start := time.Now()
+	proto, err := classifyProtocol(bufio.NewReader(server), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != ProtoUnknown {
+		t.Errorf("got %s, want %s", proto, ProtoUnknown)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("classification blocked for %v", elapsed)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Client Hints 处理方式 (-client-hints)，仅在 UA 被修改时生效
+const (
+	ClientHintsOff     = "off"     // 不处理
+	ClientHintsRewrite = "rewrite" // 按替换 UA 重写，替换 UA 不是 Chromium 时删除
+	ClientHintsRemove  = "remove"  // 删除全部 Sec-CH-UA* 头
+)
+
+// clientHintsPlatforms 将解析出的系统映射为 Sec-CH-UA-Platform 的取值
+var clientHintsPlatforms = map[string]string{
+	"Windows":  "Windows",
+	"macOS":    "macOS",
+	"Android":  "Android",
+	"iOS":      "iOS",
+	"Linux":    "Linux",
+	"ChromeOS": "Chrome OS",
+}
+
+// chromiumBrands 是 Chromium 系浏览器在 Sec-CH-UA 中声明的品牌
+var chromiumBrands = map[string]string{
+	"Chrome": "Google Chrome",
+	"Edge":   "Microsoft Edge",
+	"Opera":  "Opera",
+}
+
+// applyClientHints 使 Sec-CH-UA* 头与替换后的 UA 一致
+func applyClientHints(header http.Header, mode string, finalUA string) {
+	if mode == ClientHintsOff || !hasClientHints(header) {
+		return
+	}
+	info := parseUA(finalUA)
+	brand, chromium := chromiumBrands[info.Browser]
+	if mode == ClientHintsRemove || !chromium {
+		// 非 Chromium 浏览器不会发送 Client Hints
+		removeClientHints(header)
+		return
+	}
+
+	// Chromium 的版本取自 Chrome/ (Edge、Opera 的品牌版本与内核版本不同)
+	brandMajor, brandFull := hintVersions(info.BrowserVersion)
+	chromiumMajor, chromiumFull := hintVersions(versionAfter(finalUA, "Chrome/", false))
+	if chromiumMajor == "0" {
+		chromiumMajor, chromiumFull = brandMajor, brandFull
+	}
+	mobile := "?0"
+	if info.Device == "mobile" {
+		mobile = "?1"
+	}
+	platform, ok := clientHintsPlatforms[info.OS]
+	if !ok {
+		platform = "Unknown"
+	}
+
+	// 低熵头始终改写，高熵头只改写客户端已经发送的
+	header.Set("Sec-CH-UA", chromiumBrandList(brand, brandMajor, chromiumMajor, false))
+	header.Set("Sec-CH-UA-Mobile", mobile)
+	header.Set("Sec-CH-UA-Platform", quoteClientHint(platform))
+	if version, ok := platformVersion(info); ok {
+		setIfPresent(header, "Sec-CH-UA-Platform-Version", quoteClientHint(version))
+	} else {
+		header.Del("Sec-CH-UA-Platform-Version")
+	}
+	setIfPresent(header, "Sec-CH-UA-Full-Version", quoteClientHint(brandFull))
+	setIfPresent(header, "Sec-CH-UA-Full-Version-List", chromiumBrandList(brand, brandFull, chromiumFull, true))
+	setIfPresent(header, "Sec-CH-UA-Model", `""`)
+	// 无法从 UA 推断的头直接删除
+	for _, name := range []string{"Sec-CH-UA-Arch", "Sec-CH-UA-Bitness", "Sec-CH-UA-WoW64", "Sec-CH-UA-Form-Factors"} {
+		header.Del(name)
+	}
+}
+
+// hasClientHints 判断请求是否携带 Sec-CH-UA* 头
+func hasClientHints(header http.Header) bool {
+	for name := range header {
+		if isClientHintHeader(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeClientHints(header http.Header) {
+	for name := range header {
+		if isClientHintHeader(name) {
+			delete(header, name)
+		}
+	}
+}
+
+// isClientHintHeader 匹配 Sec-CH-UA 及 Sec-CH-UA-* (header 的键已规范化)
+func isClientHintHeader(name string) bool {
+	return name == "Sec-Ch-Ua" || strings.HasPrefix(name, "Sec-Ch-Ua-")
+}
+
+func setIfPresent(header http.Header, name string, value string) {
+	if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+		header.Set(name, value)
+	}
+}
+
+// hintVersions 返回版本号的主版本与完整版本，缺失的部分补 0
+func hintVersions(version string) (major string, full string) {
+	major, _, _ = strings.Cut(version, ".")
+	if major == "" {
+		return "0", "0.0.0.0"
+	}
+	return major, version
+}
+
+// platformVersion 返回 Chrome 在 Sec-CH-UA-Platform-Version 中报告的格式 (三段)
+// Windows 报告的不是 NT 版本：NT 10.0 对应 "10.0.0" (Windows 10 2004 及以后；Windows 11 为 13.0.0 以上，
+// 无法从 UA 区分)，更早的 NT 版本无法推断，此时删除该头
+func platformVersion(info uaInfo) (string, bool) {
+	version := info.OSVersion
+	if version == "" || (info.OS == "Windows" && version != "10.0") {
+		return "", false
+	}
+	parts := strings.Split(version, ".")
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+	return strings.Join(parts[:3], "."), true
+}
+
+// chromiumBrandList 生成 Sec-CH-UA 形式的品牌列表，brand 与 Chromium 的版本可以不同
+func chromiumBrandList(brand string, brandVersion string, chromiumVersion string, full bool) string {
+	grease := "8"
+	if full {
+		grease = "8.0.0.0"
+	}
+	return fmt.Sprintf(`"Not_A Brand";v=%q, "Chromium";v=%q, %q;v=%q`, grease, chromiumVersion, brand, brandVersion)
+}
+
+func quoteClientHint(s string) string {
+	return `"` + s + `"`
+}
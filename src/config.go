@@ -3,7 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	"regexp"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,7 +15,11 @@ import (
 )
 
 // Config 结构体保存所有应用配置
+// 运行中的 Config 不可修改，重载时整体替换
 type Config struct {
+	Args                       []string // 启动时的命令行参数，重载时重新解析
+	ArgsFile                   string   // 参数文件路径
+	ConfigFile                 string   // UCI 配置文件路径
 	UserAgent                  string
 	Port                       int
 	LogLevel                   string
@@ -22,23 +30,74 @@ type Config struct {
 	EnableRegex                bool
 	EnablePartialReplace       bool
 	KeywordsList               []string
+	KeywordsFile               string            // 额外的关键词文件 (每行一个)
+	KeywordsIgnoreCase         bool              // 关键词匹配忽略大小写 (ASCII)
+	KeywordsWholeWord          bool              // 关键词需整词匹配
+	KeywordReplacements        map[string]string // 关键词专属的替换 UA (keyword=UA)，未列出的关键词使用 UserAgent
+	KeywordMatcher             *keywordMatcher   // 由 KeywordsList 编译
+	FirewallUAMatcher          *keywordMatcher   // 由 FirewallUAWhitelist 编译
+	WhitelistMatcher           *uaWhitelist      // 由 Whitelist 编译
 	UAPattern                  string
-	UARegexp                   *regexp.Regexp
+	UARegexp                   uaPattern
+	RegexEngine                string        // 正则引擎 (re2 or regexp2)
+	RegexTimeout               time.Duration // regexp2 单次匹配超时
 	CacheSize                  int
 	BufferSize                 int
 	PoolSize                   int
-	FirewallUAWhitelist        []string      // 防火墙 UA 白名单
-	EnableFirewallUABypass     bool          // 启用防火墙非 HTTP 绕过
-	FirewallIPSetName          string        // 防火墙 set 名称
-	FirewallType               string        // 防火墙类型 (ipt or nft)
-	FirewallDropOnMatch        bool          // 防火墙匹配时断开连接
-	FirewallNonHttpThreshold   int           // 防火墙非 HTTP 判定阈值
-	FirewallTimeout            int           // 防火墙规则超时时间 (秒)
-	FirewallDecisionDelay      time.Duration // 防火墙决策延迟时间
-	FirewallHttpCooldownPeriod time.Duration // 防火墙 HTTP 冷却时间
+	GCPercent                  int                 // GOGC，0 表示不修改
+	Listeners                  int                 // SO_REUSEPORT 监听器数量
+	ShardPool                  bool                // 每个监听器使用独立的 worker 子集
+	PoolMin                    int                 // worker 数下限
+	PoolMax                    int                 // worker 数上限
+	PoolMaxWait                time.Duration       // 连接最长排队时间 (0 = 无限等待)
+	PoolOverflow               string              // 排队超时后的处理方式 (goroutine or reject)
+	DrainTimeout               time.Duration       // 退出时等待连接结束的最长时间
+	ControlSocket              string              // 控制接口 unix socket 路径
+	FirewallUAWhitelist        []string            // 防火墙 UA 白名单
+	EnableFirewallUABypass     bool                // 启用防火墙非 HTTP 绕过
+	FirewallIPSetName          string              // 防火墙 set 名称
+	FirewallType               string              // 防火墙类型 (ipt or nft)
+	FirewallDropOnMatch        bool                // 防火墙匹配时断开连接
+	FirewallNonHttpThreshold   int                 // 防火墙非 HTTP 判定阈值
+	FirewallTimeout            int                 // 防火墙规则超时时间 (秒)
+	FirewallDecisionDelay      time.Duration       // 防火墙决策延迟时间
+	FirewallHttpCooldownPeriod time.Duration       // 防火墙 HTTP 冷却时间
+	FirewallSNIAllow           []string            // 命中即立即卸载的 TLS SNI 域名
+	FirewallSNIDeny            []string            // 永不卸载的 TLS SNI 域名
+	EnableFirewallSet          bool                // 重定向规则中匹配 set 放行已卸载的连接
+	FirewallIfaces             []string            // 重定向流量的入口接口
+	FirewallBypassIPs          []string            // 不重定向的目标 IP / 网段
+	FirewallBypassPorts        []string            // 不重定向的目标端口 (支持 a-b 范围)
+	FirewallBypassGID          int                 // 本机代理时豁免的进程 GID
+	ProxyHost                  bool                // 同时重定向本机发出的流量
+	ProtocolPolicies           map[Protocol]string // 各协议的卸载策略
+	DeepScanPorts              map[int]bool        // 对非 HTTP 流量深度扫描 UA 的目标端口
+	RulesFile                  string              // 规则文件路径
+	Rules                      []*Rule             // 按顺序匹配的规则 (先于白名单与匹配模式)
+	UAStats                    bool                // 按解析出的系统/设备/浏览器统计请求
+	Audit                      bool                // 审计模式：完整执行匹配与防火墙决策 (空跑)，但原样转发所有请求
+	ClientHints                string              // 修改 UA 时 Sec-CH-UA* 头的处理方式 (off, rewrite or remove)
+	LearnWhitelist             bool                // 根据响应状态自动学习临时白名单
+	LearnThreshold             int                 // 修改 UA 后连续被拒绝多少次时加入白名单
+	LearnTTL                   time.Duration       // 学习到的条目有效期
+	HostMapFile                string              // Host 映射文件路径
+	HostMap                    *domainTrie         // 按 Host 选择替换 UA (nil = 未启用)
 }
 
-func NewConfig() (*Config, error) {
+// NewConfig 从命令行参数解析配置，可重复调用 (SIGHUP 重载时重新解析)
+func NewConfig(args []string) (*Config, error) {
+	return parseConfig(args, false)
+}
+
+// newFirewallConfig 只解析生成重定向规则需要的参数 (fw 子命令)，
+// 不读取规则文件、Host 映射等，这些选项的错误不影响防火墙规则的应用与清理
+func newFirewallConfig(args []string) (*Config, error) {
+	return parseConfig(args, true)
+}
+
+func parseConfig(args []string, firewallOnly bool) (*Config, error) {
+	fs := flag.NewFlagSet("UAmask", flag.ContinueOnError)
+
 	var (
 		userAgent                  string
 		port                       int
@@ -50,10 +109,21 @@ func NewConfig() (*Config, error) {
 		logFile                    string
 		whitelistArg               string
 		keywords                   string
+		keywordsFile               string
+		keywordsIgnoreCase         bool
+		keywordsWholeWord          bool
 		enableRegex                bool
 		cacheSize                  int
 		bufferSize                 int
 		poolSize                   int
+		listeners                  int
+		shardPool                  bool
+		poolMin                    int
+		poolMax                    int
+		poolMaxWait                time.Duration
+		poolOverflow               string
+		drainTimeout               time.Duration
+		controlSocket              string
 		firewallUAWhitelistArg     string
 		enableFirewallUABypass     bool
 		firewallIPSetName          string
@@ -63,45 +133,136 @@ func NewConfig() (*Config, error) {
 		firewallTimeout            int
 		firewallDecisionDelay      time.Duration
 		firewallHttpCooldownPeriod time.Duration
+		firewallSNIAllowArg        string
+		firewallSNIDenyArg         string
+		protocolPolicyArg          string
+		enableFirewallSet          bool
+		firewallIfacesArg          string
+		firewallBypassIPsArg       string
+		firewallBypassPortsArg     string
+		firewallBypassGID          int
+		proxyHost                  bool
+		deepScanPortsArg           string
+		rulesFile                  string
+		regexEngine                string
+		regexTimeout               time.Duration
+		hostMapFile                string
+		uaStats                    bool
+		clientHints                string
+		audit                      bool
+		learnWhitelist             bool
+		learnThreshold             int
+		learnTTL                   time.Duration
+		argsFile                   string
+		configFile                 string
+		gcPercent                  int
 	)
 
 	// 2. 注册 flag
-	flag.StringVar(&userAgent, "u", "FFF", "User-Agent string")
-	flag.IntVar(&port, "port", 8080, "TPROXY listen port")
-	flag.StringVar(&logLevel, "loglevel", "info", "Log level (debug, info, warn, error)")
-	flag.BoolVar(&showVer, "v", false, "Show version")
-	flag.StringVar(&logFile, "log", "", "Log file path (e.g., /tmp/UAmask.log). Default is stdout.")
-	flag.StringVar(&whitelistArg, "w", "", "Comma-separated User-Agent whitelist")
+	fs.StringVar(&configFile, "config", "", "UCI config file (e.g. /etc/config/UAmask); command-line flags override it (re-read on SIGHUP)")
+	fs.StringVar(&argsFile, "args-file", "", "Read additional arguments from this file, one per line (re-read on SIGHUP)")
+	fs.StringVar(&userAgent, "u", "FFF", "User-Agent string")
+	fs.IntVar(&port, "port", 8080, "TPROXY listen port")
+	fs.StringVar(&logLevel, "loglevel", "info", "Log level (debug, info, warn, error)")
+	fs.BoolVar(&showVer, "v", false, "Show version")
+	fs.StringVar(&logFile, "log", "", "Log file path (e.g., /tmp/UAmask.log). Default is stdout.")
+	fs.StringVar(&whitelistArg, "w", "", "Comma-separated User-Agent whitelist; entries may be prefixed with exact:, prefix:, contains:, glob: or regex:")
 
 	// 匹配模式
-	flag.BoolVar(&forceReplace, "force", false, "Force replace User-Agent (match_mode 'all')")
-	flag.BoolVar(&enableRegex, "enable-regex", false, "Enable Regex matching mode")
-	flag.StringVar(&keywords, "keywords", "iPhone,iPad,Android,Macintosh,Windows", "Comma-separated User-Agent keywords (default mode)")
-	flag.StringVar(&uaPattern, "r", "(iPhone|iPad|Android|Macintosh|Windows|Linux|Apple|Mac OS X|Mobile)", "UA-Pattern (Regex)")
-	flag.BoolVar(&enablePartialReplace, "s", false, "Enable Regex Partial Replace (regex mode + partial)")
+	fs.BoolVar(&forceReplace, "force", false, "Force replace User-Agent (match_mode 'all')")
+	fs.BoolVar(&enableRegex, "enable-regex", false, "Enable Regex matching mode")
+	fs.StringVar(&keywords, "keywords", "iPhone,iPad,Android,Macintosh,Windows", "Comma-separated User-Agent keywords (default mode); keyword=UA gives a keyword its own replacement, the earliest listed keyword wins when several match. A replacement UA containing commas only works in -keywords-file")
+	fs.StringVar(&keywordsFile, "keywords-file", "", "File with additional User-Agent keywords, one per line, listed after -keywords; keyword=UA lines may contain commas (re-read on SIGHUP)")
+	fs.BoolVar(&keywordsIgnoreCase, "keywords-ignore-case", false, "Match keywords and firewall UA whitelist case-insensitively (ASCII)")
+	fs.BoolVar(&keywordsWholeWord, "keywords-whole-word", false, "Match keywords and firewall UA whitelist only at word boundaries")
+	fs.StringVar(&uaPattern, "r", "(iPhone|iPad|Android|Macintosh|Windows|Linux|Apple|Mac OS X|Mobile)", "UA-Pattern (Regex)")
+	fs.BoolVar(&enablePartialReplace, "s", false, "Enable Regex Partial Replace (regex mode + partial)")
+	fs.StringVar(&regexEngine, "regex-engine", RegexEngineRE2, "Regex engine for UA patterns: re2 (linear time) or regexp2 (lookaround, backreferences); partial replacement templates ($1, ${name}) follow Go's regexp rules with either engine")
+	fs.DurationVar(&regexTimeout, "regex-timeout", 100*time.Millisecond, "Match timeout for a single UA when using the regexp2 engine; a timed-out UA is forwarded unchanged and not cached")
+
+	fs.StringVar(&rulesFile, "rules", "", "Ordered rule file combining ua/host/dst/dport/src conditions with replace/pass/offload/drop actions (re-read on SIGHUP)")
+	fs.StringVar(&hostMapFile, "host-map", "", "File mapping Host domains (example.com, *.example.com) to a replacement User-Agent or 'pass' (re-read on SIGHUP)")
+	fs.BoolVar(&audit, "audit", false, "Observe-only mode: log and count what would be modified, dropped or offloaded, but forward every request unchanged")
+	fs.StringVar(&clientHints, "client-hints", ClientHintsOff, "Sec-CH-UA* headers when the UA is modified: off, rewrite (match the replacement UA) or remove")
+	fs.BoolVar(&learnWhitelist, "learn-whitelist", false, "Stop modifying the UA for a host that keeps answering 403/406 to modified requests only")
+	fs.IntVar(&learnThreshold, "learn-threshold", 3, "Consecutive rejected modified requests before a host is whitelisted")
+	fs.DurationVar(&learnTTL, "learn-ttl", time.Hour, "How long a learned whitelist entry lasts")
+	fs.BoolVar(&uaStats, "ua-stats", false, "Count requests by parsed OS, device class and browser in the stats output")
+	fs.StringVar(&deepScanPortsArg, "deep-scan-ports", "", "Comma-separated destination ports whose non-HTTP streams are scanned for User-Agent lines")
 
 	// 性能调优
-	flag.IntVar(&cacheSize, "cache-size", 1000, "LRU cache size")
-	flag.IntVar(&bufferSize, "buffer-size", 8192, "I/O buffer size (bytes)")
-	flag.IntVar(&poolSize, "p", 0, "Worker pool size (0 or less = one goroutine per connection)")
+	fs.IntVar(&cacheSize, "cache-size", 1000, "LRU cache size")
+	fs.IntVar(&bufferSize, "buffer-size", 8192, "I/O buffer size (bytes)")
+	fs.IntVar(&poolSize, "p", 0, "Worker pool size (0 or less = one goroutine per connection)")
+	fs.IntVar(&gcPercent, "gogc", 0, "Garbage collection target percentage, same as GOGC (0 = leave unchanged)")
+	fs.IntVar(&listeners, "listeners", 0, "Number of SO_REUSEPORT listeners, each with its own accept loop (0 = number of CPU cores)")
+	fs.BoolVar(&shardPool, "shard-pool", false, "Split the worker pool into one subset per listener")
+	fs.IntVar(&poolMin, "pool-min", 0, "Minimum worker count when auto-scaling the pool (0 = pool size)")
+	fs.IntVar(&poolMax, "pool-max", 0, "Maximum worker count when auto-scaling the pool (0 = pool size)")
+	fs.DurationVar(&poolMaxWait, "pool-wait", 0, "Maximum time a connection may wait in the pool queue (0 = wait indefinitely)")
+	fs.StringVar(&poolOverflow, "pool-overflow", PoolOverflowGoroutine, "Action when the pool queue wait is exceeded (goroutine or reject)")
+	fs.StringVar(&controlSocket, "control", "", "Unix socket path for the local control API (GET /stats, POST /reload, GET/DELETE /learned)")
+	fs.DurationVar(&drainTimeout, "drain-timeout", 10*time.Second, "Maximum time to let active connections finish on SIGTERM/SIGINT")
 
 	// 防火墙绕过
-	flag.StringVar(&firewallUAWhitelistArg, "fw-ua-w", "", "Comma-separated User-Agent firewall whitelist keywords")
-	flag.BoolVar(&enableFirewallUABypass, "fw-bypass", false, "Enable firewall bypass for non-HTTP traffic")
-	flag.StringVar(&firewallIPSetName, "fw-set-name", "UAmask_bypass_set", "Firewall ipset/nfset name")
-	flag.StringVar(&firewallType, "fw-type", "ipt", "Firewall type (ipt or nft)")
-	flag.BoolVar(&firewallDropOnMatch, "fw-drop", false, "Drop connections that match firewall rules")
+	fs.StringVar(&firewallUAWhitelistArg, "fw-ua-w", "", "Comma-separated User-Agent firewall whitelist keywords")
+	fs.BoolVar(&enableFirewallUABypass, "fw-bypass", false, "Enable firewall bypass for non-HTTP traffic")
+	fs.StringVar(&firewallIPSetName, "fw-set-name", "UAmask_bypass_set", "Firewall ipset/nfset name")
+	fs.StringVar(&firewallType, "fw-type", "ipt", "Firewall type (ipt or nft)")
+	fs.BoolVar(&firewallDropOnMatch, "fw-drop", false, "Drop connections that match firewall rules")
 
-	flag.IntVar(&firewallNonHttpThreshold, "fw-nonhttp-threshold", 5, "Firewall non-HTTP traffic threshold")
-	flag.IntVar(&firewallTimeout, "fw-timeout", 8*3600, "Firewall rule timeout in seconds")
-	flag.DurationVar(&firewallDecisionDelay, "fw-decision-delay", 60*time.Second, "Firewall decision delay duration")
-	flag.DurationVar(&firewallHttpCooldownPeriod, "fw-http-cooldown", 1*time.Hour, "Firewall HTTP cooldown period")
+	fs.IntVar(&firewallNonHttpThreshold, "fw-nonhttp-threshold", 5, "Firewall non-HTTP traffic threshold")
+	fs.IntVar(&firewallTimeout, "fw-timeout", 8*3600, "Firewall rule timeout in seconds")
+	fs.DurationVar(&firewallDecisionDelay, "fw-decision-delay", 60*time.Second, "Firewall decision delay duration")
+	fs.DurationVar(&firewallHttpCooldownPeriod, "fw-http-cooldown", 1*time.Hour, "Firewall HTTP cooldown period")
+	fs.StringVar(&firewallSNIAllowArg, "fw-sni-allow", "", "Comma-separated TLS SNI domains to offload immediately")
+	fs.StringVar(&firewallSNIDenyArg, "fw-sni-deny", "", "Comma-separated TLS SNI domains never to offload")
+	fs.StringVar(&protocolPolicyArg, "proto-policy", "", "Comma-separated per-protocol offload policy, e.g. bittorrent=offload,unknown=never (policy: score, offload, never)")
 
-	// 3. 解析 flag
-	flag.Parse()
+	// 重定向规则 (fw apply / fw remove)
+	fs.BoolVar(&enableFirewallSet, "fw-set", false, "Return connections found in the firewall set before redirecting")
+	fs.StringVar(&firewallIfacesArg, "fw-iface", "br-lan", "Comma or space separated interfaces whose TCP traffic is redirected")
+	fs.StringVar(&firewallBypassIPsArg, "fw-bypass-ips", "", "Comma or space separated destination IPs/CIDRs that are not redirected")
+	fs.StringVar(&firewallBypassPortsArg, "fw-bypass-ports", "", "Comma or space separated destination ports (or ranges a-b) that are not redirected")
+	fs.IntVar(&firewallBypassGID, "fw-bypass-gid", 65533, "GID whose traffic is not redirected when proxying the router itself")
+	fs.BoolVar(&proxyHost, "proxy-host", false, "Also redirect TCP traffic originating from the router itself")
+
+	// 3. 解析 flag：先解析命令行找到配置文件与参数文件，
+	// 再依次应用 UCI 配置、参数文件和命令行 (后者覆盖前者)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	configPath, argsPath := configFile, argsFile
+	if configPath != "" {
+		uciArgs, err := loadUCIArgs(configPath, firewallOnly)
+		if err != nil {
+			return nil, err
+		}
+		if err := fs.Parse(uciArgs); err != nil {
+			return nil, fmt.Errorf("invalid option in %s: %w", configPath, err)
+		}
+	}
+	if argsPath != "" {
+		fileArgs, err := readArgsFile(argsPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := fs.Parse(fileArgs); err != nil {
+			return nil, fmt.Errorf("invalid argument in %s: %w", argsPath, err)
+		}
+	}
+	if configPath != "" || argsPath != "" {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+	}
 
 	// 4. 结构体
 	cfg := &Config{
+		Args:                 args,
+		ArgsFile:             argsPath,
+		ConfigFile:           configPath,
+		GCPercent:            gcPercent,
 		UserAgent:            userAgent,
 		Port:                 port,
 		LogLevel:             logLevel,
@@ -113,6 +274,27 @@ func NewConfig() (*Config, error) {
 		CacheSize:            cacheSize,
 		BufferSize:           bufferSize,
 		PoolSize:             poolSize,
+		Listeners:            listeners,
+		ShardPool:            shardPool,
+		PoolMin:              poolMin,
+		PoolMax:              poolMax,
+		PoolMaxWait:          poolMaxWait,
+		PoolOverflow:         poolOverflow,
+		DrainTimeout:         drainTimeout,
+		ControlSocket:        controlSocket,
+		RulesFile:            rulesFile,
+		RegexEngine:          regexEngine,
+		KeywordsFile:         keywordsFile,
+		KeywordsIgnoreCase:   keywordsIgnoreCase,
+		KeywordsWholeWord:    keywordsWholeWord,
+		RegexTimeout:         regexTimeout,
+		HostMapFile:          hostMapFile,
+		UAStats:              uaStats,
+		ClientHints:          clientHints,
+		Audit:                audit,
+		LearnWhitelist:       learnWhitelist,
+		LearnThreshold:       learnThreshold,
+		LearnTTL:             learnTTL,
 		Whitelist:            []string{},
 		KeywordsList:         []string{},
 
@@ -125,6 +307,16 @@ func NewConfig() (*Config, error) {
 		FirewallTimeout:            firewallTimeout,
 		FirewallDecisionDelay:      firewallDecisionDelay,
 		FirewallHttpCooldownPeriod: firewallHttpCooldownPeriod,
+		EnableFirewallSet:          enableFirewallSet,
+		FirewallIfaces:             splitFields(firewallIfacesArg),
+		FirewallBypassIPs:          splitFields(firewallBypassIPsArg),
+		FirewallBypassPorts:        splitFields(firewallBypassPortsArg),
+		FirewallBypassGID:          firewallBypassGID,
+		ProxyHost:                  proxyHost,
+	}
+	if firewallOnly {
+		// 参数由 validateFirewallConfig 校验
+		return cfg, nil
 	}
 
 	// 处理白名单
@@ -149,6 +341,71 @@ func NewConfig() (*Config, error) {
 		}
 	}
 
+	// TLS SNI 卸载名单
+	cfg.FirewallSNIAllow = splitDomainList(firewallSNIAllowArg)
+	cfg.FirewallSNIDeny = splitDomainList(firewallSNIDenyArg)
+
+	// 协议卸载策略
+	policies, err := parseProtocolPolicies(protocolPolicyArg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol policy: %w", err)
+	}
+	cfg.ProtocolPolicies = policies
+
+	// 深度扫描端口
+	cfg.DeepScanPorts = make(map[int]bool)
+	for _, s := range strings.Split(deepScanPortsArg, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := strconv.Atoi(s)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid deep scan port: %q", s)
+		}
+		cfg.DeepScanPorts[p] = true
+	}
+
+	// 正则引擎 (UA 正则与规则文件共用)
+	if cfg.RegexEngine != RegexEngineRE2 && cfg.RegexEngine != RegexEngineRegexp2 {
+		return nil, fmt.Errorf("invalid regex engine: %s", cfg.RegexEngine)
+	}
+	if cfg.ClientHints != ClientHintsOff && cfg.ClientHints != ClientHintsRewrite && cfg.ClientHints != ClientHintsRemove {
+		return nil, fmt.Errorf("invalid client hints mode: %s", cfg.ClientHints)
+	}
+	if cfg.LearnThreshold < 1 {
+		return nil, fmt.Errorf("invalid learn threshold: %d", cfg.LearnThreshold)
+	}
+	if cfg.LearnTTL <= 0 {
+		return nil, fmt.Errorf("invalid learn ttl: %s", cfg.LearnTTL)
+	}
+	if cfg.RegexTimeout <= 0 {
+		return nil, fmt.Errorf("invalid regex timeout: %s", cfg.RegexTimeout)
+	}
+	compiler := patternCompiler{engine: cfg.RegexEngine, timeout: cfg.RegexTimeout}
+
+	// UA 白名单
+	cfg.WhitelistMatcher, err = newUAWhitelist(cfg.Whitelist, compiler)
+	if err != nil {
+		return nil, err
+	}
+
+	// 规则文件
+	if cfg.RulesFile != "" {
+		cfg.Rules, err = LoadRules(cfg.RulesFile, compiler)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Host 映射
+	if cfg.HostMapFile != "" {
+		cfg.HostMap, err = LoadHostMap(cfg.HostMapFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// 验证配置
 	if cfg.Port < 1 || cfg.Port > 65535 {
 		return nil, fmt.Errorf("invalid port: %d", cfg.Port)
@@ -156,16 +413,45 @@ func NewConfig() (*Config, error) {
 	if cfg.BufferSize < 1024 || cfg.BufferSize > 65536 {
 		return nil, fmt.Errorf("invalid buffer size: %d", cfg.BufferSize)
 	}
+	if cfg.Listeners < 0 || cfg.Listeners > 64 {
+		return nil, fmt.Errorf("invalid listener count: %d", cfg.Listeners)
+	}
+	if cfg.Listeners == 0 {
+		cfg.Listeners = runtime.NumCPU()
+	}
+	if cfg.PoolSize > 0 {
+		// 初始大小即 -p，需落在 [min, max] 内
+		if cfg.PoolMin <= 0 || cfg.PoolMin > cfg.PoolSize {
+			cfg.PoolMin = cfg.PoolSize
+		}
+		if cfg.PoolMax < cfg.PoolSize {
+			cfg.PoolMax = cfg.PoolSize
+		}
+	}
+	if cfg.PoolMaxWait < 0 {
+		return nil, fmt.Errorf("invalid pool wait: %s", cfg.PoolMaxWait)
+	}
+	if cfg.PoolOverflow != PoolOverflowGoroutine && cfg.PoolOverflow != PoolOverflowReject {
+		return nil, fmt.Errorf("invalid pool overflow action: %s", cfg.PoolOverflow)
+	}
+	if cfg.GCPercent < 0 {
+		return nil, fmt.Errorf("invalid gogc value: %d", cfg.GCPercent)
+	}
+	if cfg.DrainTimeout < 0 {
+		return nil, fmt.Errorf("invalid drain timeout: %s", cfg.DrainTimeout)
+	}
 	if cfg.CacheSize < 0 {
 		return nil, fmt.Errorf("invalid cache size: %d", cfg.CacheSize)
 	}
+	if cfg.FirewallBypassGID < 0 {
+		return nil, fmt.Errorf("invalid bypass gid: %d", cfg.FirewallBypassGID)
+	}
 
 	// 根据模式处理 keywords 或 regex
 	if cfg.EnableRegex {
 		// 正则模式
 		cfg.UAPattern = "(?i)" + uaPattern
-		var err error
-		cfg.UARegexp, err = regexp.Compile(cfg.UAPattern)
+		cfg.UARegexp, err = compiler.Compile(cfg.UAPattern)
 		if err != nil {
 			return nil, fmt.Errorf("invalid User-Agent Regex Pattern: %w", err)
 		}
@@ -177,14 +463,117 @@ func NewConfig() (*Config, error) {
 				cfg.KeywordsList = append(cfg.KeywordsList, s)
 			}
 		}
+		if cfg.KeywordsFile != "" {
+			fileKeywords, err := readKeywordsFile(cfg.KeywordsFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.KeywordsList = append(cfg.KeywordsList, fileKeywords...)
+		}
+		cfg.KeywordsList, cfg.KeywordReplacements, err = splitKeywordReplacements(cfg.KeywordsList)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keywords: %w", err)
+		}
 	}
+	cfg.KeywordMatcher = newKeywordMatcher(cfg.KeywordsList, cfg.KeywordsIgnoreCase, cfg.KeywordsWholeWord)
+	cfg.FirewallUAMatcher = newKeywordMatcher(cfg.FirewallUAWhitelist, cfg.KeywordsIgnoreCase, cfg.KeywordsWholeWord)
 
 	// 6. 返回配置实例
 	return cfg, nil
 }
 
+// staticChanges 返回相对 c 发生变化、但需要重启才能生效的参数
+func (c *Config) staticChanges(n *Config) []string {
+	var changed []string
+	check := func(name string, diff bool) {
+		if diff {
+			changed = append(changed, name)
+		}
+	}
+	check("port", c.Port != n.Port)
+	check("listeners", c.Listeners != n.Listeners)
+	check("buffer-size", c.BufferSize != n.BufferSize)
+	check("p", c.PoolSize != n.PoolSize)
+	check("pool-min", c.PoolMin != n.PoolMin)
+	check("pool-max", c.PoolMax != n.PoolMax)
+	check("pool-wait", c.PoolMaxWait != n.PoolMaxWait)
+	check("pool-overflow", c.PoolOverflow != n.PoolOverflow)
+	check("shard-pool", c.ShardPool != n.ShardPool)
+	check("log", c.LogFile != n.LogFile)
+	check("control", c.ControlSocket != n.ControlSocket)
+	return changed
+}
+
+// keepStatic 将需要重启才能生效的参数恢复为运行中的值
+func (c *Config) keepStatic(old *Config) {
+	c.Port = old.Port
+	c.Listeners = old.Listeners
+	c.BufferSize = old.BufferSize
+	c.PoolSize = old.PoolSize
+	c.PoolMin = old.PoolMin
+	c.PoolMax = old.PoolMax
+	c.PoolMaxWait = old.PoolMaxWait
+	c.PoolOverflow = old.PoolOverflow
+	c.ShardPool = old.ShardPool
+	c.LogFile = old.LogFile
+	c.ControlSocket = old.ControlSocket
+}
+
+// rulesChanged 判断影响 UA 匹配结果 (即缓存内容) 的参数是否变化
+func (c *Config) rulesChanged(n *Config) bool {
+	return c.UserAgent != n.UserAgent ||
+		c.ForceReplace != n.ForceReplace ||
+		c.EnableRegex != n.EnableRegex ||
+		c.EnablePartialReplace != n.EnablePartialReplace ||
+		c.UAPattern != n.UAPattern ||
+		c.RegexEngine != n.RegexEngine ||
+		!slices.Equal(c.KeywordsList, n.KeywordsList) ||
+		!maps.Equal(c.KeywordReplacements, n.KeywordReplacements) ||
+		c.KeywordsIgnoreCase != n.KeywordsIgnoreCase ||
+		c.KeywordsWholeWord != n.KeywordsWholeWord ||
+		!slices.Equal(c.Whitelist, n.Whitelist) ||
+		!slices.Equal(c.FirewallUAWhitelist, n.FirewallUAWhitelist) ||
+		// 映射文件在重载时重新读取，内容可能已变化
+		c.HostMapFile != "" || n.HostMapFile != ""
+}
+
+// readArgsFile 读取参数文件，每行一个参数 (不做引号与空白处理)
+func readArgsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read args file: %w", err)
+	}
+	content := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if content == "" {
+		return nil, nil
+	}
+	return strings.Split(content, "\n"), nil
+}
+
+// splitDomainList 解析逗号分隔的域名列表，统一转为小写
+func splitDomainList(arg string) []string {
+	domains := []string{}
+	for _, s := range strings.Split(arg, ",") {
+		s = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+		if s != "" {
+			domains = append(domains, s)
+		}
+	}
+	return domains
+}
+
+// splitFields 按逗号或空白切分列表参数 (UCI list 与逗号分隔均可)
+func splitFields(arg string) []string {
+	return strings.FieldsFunc(arg, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
 func (c *Config) LogConfig(version string) {
 	logrus.Infof("UA-MASK v%s", version)
+	if c.ConfigFile != "" {
+		logrus.Infof("Config File: %s", c.ConfigFile)
+	}
 	logrus.Infof("Port: %d", c.Port)
 	logrus.Infof("User-Agent: %s", c.UserAgent)
 	logrus.Infof("Log level: %s", c.LogLevel)
@@ -192,6 +581,23 @@ func (c *Config) LogConfig(version string) {
 	logrus.Infof("Cache Size: %d", c.CacheSize)
 	logrus.Infof("Buffer Size: %d", c.BufferSize)
 	logrus.Infof("Worker Pool Size: %d", c.PoolSize)
+	if c.GCPercent > 0 {
+		logrus.Infof("GOGC: %d", c.GCPercent)
+	}
+	logrus.Infof("Listeners: %d (sharded pool: %v)", c.Listeners, c.ShardPool)
+	if c.PoolSize > 0 {
+		logrus.Infof("Worker Pool Range: %d-%d (max wait: %s, overflow: %s)", c.PoolMin, c.PoolMax, c.PoolMaxWait, c.PoolOverflow)
+	}
+	logrus.Infof("Drain Timeout: %s", c.DrainTimeout)
+	if len(c.DeepScanPorts) > 0 {
+		logrus.Infof("Deep Scan Ports: %v", c.DeepScanPorts)
+	}
+	if c.RulesFile != "" {
+		logrus.Infof("Rules File: %s (%d rules)", c.RulesFile, len(c.Rules))
+	}
+	if c.HostMapFile != "" {
+		logrus.Infof("Host Map File: %s", c.HostMapFile)
+	}
 
 	// 日志
 	logrus.Infof("Firewall Type: %s", c.FirewallType)
@@ -203,12 +609,35 @@ func (c *Config) LogConfig(version string) {
 	logrus.Infof("Firewall Rule Timeout (seconds): %d", c.FirewallTimeout)
 	logrus.Infof("Firewall Decision Delay: %s", c.FirewallDecisionDelay)
 	logrus.Infof("Firewall HTTP Cooldown Period: %s", c.FirewallHttpCooldownPeriod)
+	logrus.Infof("Firewall SNI Allow: %v", c.FirewallSNIAllow)
+	logrus.Infof("Firewall SNI Deny: %v", c.FirewallSNIDeny)
+	logrus.Infof("Firewall Set Match: %v", c.EnableFirewallSet)
+	logrus.Infof("Firewall Interfaces: %v", c.FirewallIfaces)
+	logrus.Infof("Firewall Bypass IPs: %v", c.FirewallBypassIPs)
+	logrus.Infof("Firewall Bypass Ports: %v", c.FirewallBypassPorts)
+	logrus.Infof("Proxy Host: %v (bypass gid %d)", c.ProxyHost, c.FirewallBypassGID)
+	logrus.Infof("Protocol Policies: %v", c.ProtocolPolicies)
+	logrus.Infof("UA Stats: %v", c.UAStats)
+	logrus.Infof("Client Hints: %s", c.ClientHints)
+	if c.Audit {
+		logrus.Warn("Audit Mode: requests are forwarded unchanged, firewall offloads are not applied")
+	}
+	logrus.Infof("Learn Whitelist: %v (threshold %d, ttl %s)", c.LearnWhitelist, c.LearnThreshold, c.LearnTTL)
 
 	if c.ForceReplace {
 		logrus.Info("Mode: Force Replace (All)")
 	} else if c.EnableRegex {
-		logrus.Infof("Mode: Regex | Pattern: %s | Partial Replace: %v", c.UAPattern, c.EnablePartialReplace)
+		logrus.Infof("Mode: Regex | Pattern: %s | Partial Replace: %v | Engine: %s", c.UAPattern, c.EnablePartialReplace, c.RegexEngine)
 	} else {
-		logrus.Infof("Mode: Keywords | Keywords: %v", c.KeywordsList)
+		if c.KeywordsFile != "" {
+			logrus.Infof("Mode: Keywords | %d keywords (file: %s) | Ignore Case: %v | Whole Word: %v", len(c.KeywordsList), c.KeywordsFile, c.KeywordsIgnoreCase, c.KeywordsWholeWord)
+		} else {
+			logrus.Infof("Mode: Keywords | Keywords: %v | Ignore Case: %v | Whole Word: %v", c.KeywordsList, c.KeywordsIgnoreCase, c.KeywordsWholeWord)
+		}
+		for _, kw := range c.KeywordsList {
+			if ua, ok := c.KeywordReplacements[kw]; ok {
+				logrus.Infof("Keyword Replacement: %s -> %s", kw, ua)
+			}
+		}
 	}
 }
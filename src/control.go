@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StartControlServer 在 unix socket 上提供本地控制接口:
+//
+//	GET    /stats   当前统计
+//	POST   /reload  重新加载配置
+//	GET    /learned 自动学习的白名单 (每行 "<host> <剩余秒数>")
+//	DELETE /learned?host=<host> 撤销一项，不带 host 时清空
+func StartControlServer(path string, stats *Stats, reloader *Reloader, learned *learnedWhitelist) (net.Listener, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("control socket listen failed: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("control socket chmod failed: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, stats.Render())
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloader.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/learned", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, e := range learned.Entries() {
+				fmt.Fprintf(w, "%s %d\n", e.Host, int(time.Until(e.Expires).Seconds()))
+			}
+		case http.MethodDelete:
+			host := r.URL.Query().Get("host")
+			n := learned.Revoke(host)
+			if host != "" && n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			logrus.Infof("[Control] Revoked %d learned whitelist entries", n)
+			fmt.Fprintln(w, "ok")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logrus.Debugf("[Control] Control server stopped: %v", err)
+		}
+	}()
+	logrus.Infof("[Control] Control API listening on unix:%s", path)
+	return listener, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var uaHeaderToken = []byte("User-Agent:")
+
+// deepScanHoldWait 是疑似 token 前缀或未结束的 UA 行等待后续数据的最长时间
+// 超时后原样转发已缓冲的字节，避免请求-响应式协议因末尾几个字节被扣留而互相等待
+const deepScanHoldWait = 200 * time.Millisecond
+
+// deepScanCopy 流式转发非 HTTP 数据，在任意位置查找 "User-Agent:" 行并原地改写
+// 替换值与原值等长 (不足补空格，超出截断)，因此不会破坏外层协议的长度字段
+// 注意：疑似 token 前缀或未结束的 UA 行最多等待 deepScanHoldWait，之后原样转发
+// 命中需要断开的规则时返回 errDropConnection
+func (h *HTTPHandler) deepScanCopy(dst io.Writer, conn net.Conn, src *bufio.Reader, destAddrPort string, destIP string, destPort int, srcIP string) error {
+	for {
+		if _, err := src.Peek(1); err != nil {
+			return err
+		}
+		buf, _ := src.Peek(src.Buffered())
+
+		i := indexFold(buf, uaHeaderToken)
+		if i < 0 {
+			// 保留可能跨块的 token 前缀
+			hold := partialPrefixLen(buf, uaHeaderToken)
+			if hold == len(buf) {
+				if _, err := peekHeld(conn, func() ([]byte, error) { return src.Peek(len(buf) + 1) }); err != nil {
+					// 没有更多数据 (或等待超时)，原样转发
+					if werr := copyDiscard(dst, src, len(buf)); werr != nil {
+						return werr
+					}
+					if !errors.Is(err, os.ErrDeadlineExceeded) {
+						return err
+					}
+				}
+				continue
+			}
+			if err := copyDiscard(dst, src, len(buf)-hold); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := copyDiscard(dst, src, i); err != nil {
+			return err
+		}
+		line, err := peekHeld(conn, func() ([]byte, error) { return peekUntil(src, []byte("\n")) })
+		if err != nil {
+			// 行过长、等待超时或连接结束，原样转发 token 并继续扫描
+			if err := copyDiscard(dst, src, len(uaHeaderToken)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lineLen := len(line)
+		rewritten, drop := h.rewriteUALine(line, destAddrPort, destIP, destPort, srcIP)
+		if drop {
+			return errDropConnection
+		}
+		if _, err := dst.Write(rewritten); err != nil {
+			return err
+		}
+		if _, err := src.Discard(lineLen); err != nil {
+			return err
+		}
+	}
+}
+
+// peekHeld 执行 peek，最多等待 deepScanHoldWait
+func peekHeld(conn net.Conn, peek func() ([]byte, error)) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(deepScanHoldWait))
+	defer conn.SetReadDeadline(time.Time{})
+	return peek()
+}
+
+// rewriteUALine 改写 "User-Agent: xxx\r\n" 行，返回等长的新行，需要断开连接时 drop 为 true
+func (h *HTTPHandler) rewriteUALine(line []byte, destAddrPort string, destIP string, destPort int, srcIP string) (rewritten []byte, drop bool) {
+	out := make([]byte, len(line))
+	copy(out, line)
+
+	start := len(uaHeaderToken)
+	for start < len(out) && (out[start] == ' ' || out[start] == '\t') {
+		start++
+	}
+	end := len(out)
+	for end > start && (out[end-1] == '\n' || out[end-1] == '\r') {
+		end--
+	}
+	if end <= start {
+		return out, false
+	}
+
+	uaStr := string(out[start:end])
+	h.stats.IncDeepScanHits()
+	decision := h.processUA(uaStr, destAddrPort, destIP, destPort, srcIP, "")
+	if decision.drop {
+		return nil, true
+	}
+	if decision.finalUA == uaStr {
+		return out, false
+	}
+
+	value := out[start:end]
+	n := copy(value, decision.finalUA)
+	for ; n < len(value); n++ {
+		value[n] = ' '
+	}
+	logrus.Debugf("[Handler] [%s] Deep scan rewrote UA in place: %s -> %s", destAddrPort, uaStr, string(value))
+	return out, false
+}
+
+// copyDiscard 将 src 缓冲区中的前 n 个字节写入 dst 并消费
+func copyDiscard(dst io.Writer, src *bufio.Reader, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	buf, err := src.Peek(n)
+	if len(buf) > 0 {
+		if _, werr := dst.Write(buf); werr != nil {
+			return werr
+		}
+		src.Discard(len(buf))
+	}
+	return err
+}
+
+// indexFold 大小写不敏感地查找 token
+func indexFold(buf, token []byte) int {
+	for i := 0; i+len(token) <= len(buf); i++ {
+		if buf[i]|0x20 == token[0]|0x20 && bytes.EqualFold(buf[i:i+len(token)], token) {
+			return i
+		}
+	}
+	return -1
+}
+
+// partialPrefixLen 返回 buf 末尾与 token 前缀相同的最长长度
+func partialPrefixLen(buf, token []byte) int {
+	k := len(token) - 1
+	if k > len(buf) {
+		k = len(buf)
+	}
+	for ; k > 0; k-- {
+		if bytes.EqualFold(buf[len(buf)-k:], token[:k]) {
+			return k
+		}
+	}
+	return 0
+}
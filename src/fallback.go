@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// headerBlockEnd 返回请求头结束位置 (空行之后)，兼容裸 LF，不存在时返回 -1
+func headerBlockEnd(buf []byte) int {
+	for i := 0; i < len(buf); {
+		j := bytes.IndexByte(buf[i:], '\n')
+		if j < 0 {
+			return -1
+		}
+		i += j + 1
+		if i < len(buf) && buf[i] == '\n' {
+			return i + 1
+		}
+		if i+1 < len(buf) && buf[i] == '\r' && buf[i+1] == '\n' {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// rewriteRawHeader 逐行扫描原始请求头并改写 User-Agent 行，不依赖严格的 HTTP 解析
+// bodyLen 为根据 Content-Length 推断的 body 长度，无法确定 (如 chunked) 时为 -1
+func (h *HTTPHandler) rewriteRawHeader(raw []byte, destAddrPort string, destIP string, destPort int, srcIP string) (out []byte, uaFound bool, bodyLen int64, drop bool) {
+	out = make([]byte, 0, len(raw)+len(h.config.Load().UserAgent))
+	host := rawHeaderHost(raw)
+	modifiedUA := ""    // 被修改时的新 UA，用于之后改写 Client Hints
+	lengthSeen := false // 已出现过 Content-Length (值可能为 0)
+	firstLine := true
+	for len(raw) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line, raw = raw[:i+1], raw[i+1:]
+		} else {
+			// 不完整的行原样保留
+			line, raw = raw, nil
+		}
+		if firstLine {
+			firstLine = false
+			out = append(out, line...)
+			continue
+		}
+
+		content := bytes.TrimRight(line, "\r\n")
+		name, value, ok := bytes.Cut(content, []byte(":"))
+		if !ok || len(line) == len(content) {
+			out = append(out, line...)
+			continue
+		}
+		name = bytes.TrimSpace(name)
+		switch {
+		case bytes.EqualFold(name, []byte("User-Agent")):
+			uaStr := string(bytes.TrimSpace(value))
+			if uaStr == "" {
+				break
+			}
+			uaFound = true
+			decision := h.processUA(uaStr, destAddrPort, destIP, destPort, srcIP, host)
+			if decision.drop {
+				return nil, uaFound, bodyLen, true
+			}
+			if decision.finalUA != uaStr {
+				modifiedUA = decision.finalUA
+			}
+			out = append(out, name...)
+			out = append(out, ": "...)
+			out = append(out, decision.finalUA...)
+			out = append(out, line[len(content):]...)
+			continue
+		case bytes.EqualFold(name, []byte("Content-Length")):
+			n, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+			// 多个 Content-Length 的值不一致时无法确定请求边界
+			if err != nil || n < 0 || (lengthSeen && bodyLen != n) {
+				bodyLen = -1
+			} else if bodyLen >= 0 {
+				bodyLen = n
+			}
+			lengthSeen = true
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			bodyLen = -1
+		}
+		out = append(out, line...)
+	}
+	if modifiedUA != "" {
+		out = rewriteRawClientHints(out, h.config.Load().ClientHints, modifiedUA)
+	}
+	return out, uaFound, bodyLen, false
+}
+
+// rewriteRawClientHints 对原始请求头中的 Sec-CH-UA* 行执行 applyClientHints
+// 这些行被移除，处理结果按名称排序后写回第一个 Sec-CH-UA* 行的位置
+func rewriteRawClientHints(raw []byte, mode string, finalUA string) []byte {
+	if mode == ClientHintsOff {
+		return raw
+	}
+	header := http.Header{}
+	out := make([]byte, 0, len(raw))
+	insertAt := -1
+	eol := "\r\n"
+	for i, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		content := bytes.TrimRight(line, "\r\n")
+		name, value, ok := bytes.Cut(content, []byte(":"))
+		key := http.CanonicalHeaderKey(string(bytes.TrimSpace(name)))
+		if i == 0 || !ok || !isClientHintHeader(key) {
+			out = append(out, line...)
+			continue
+		}
+		if insertAt < 0 {
+			insertAt = len(out)
+			eol = string(line[len(content):])
+		}
+		header.Add(key, string(bytes.TrimSpace(value)))
+	}
+	if insertAt < 0 {
+		return raw
+	}
+
+	applyClientHints(header, mode, finalUA)
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var hints []byte
+	for _, name := range names {
+		for _, value := range header[name] {
+			hints = append(hints, name+": "+value+eol...)
+		}
+	}
+	return slices.Insert(out, insertAt, hints...)
+}
+
+// rawHeaderHost 从原始请求头中查找 Host (供规则匹配)，UA 行可能位于 Host 之前
+func rawHeaderHost(raw []byte) string {
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(bytes.TrimSpace(name), []byte("Host")) {
+			return requestHost(string(bytes.TrimSpace(value)))
+		}
+	}
+	return ""
+}
+
+// fallbackRawRequest 在 http.ReadRequest 失败后转发原始请求头：
+// 先尝试宽松的逐行 UA 改写，失败则原样转发；返回是否可以继续解析后续请求
+// complete 为 false 表示 raw 只是缓冲区中的部分请求头 (超长请求头)
+func (h *HTTPHandler) fallbackRawRequest(dst net.Conn, src net.Conn, dstWriter *bufio.Writer, srcReader *bufio.Reader, raw []byte, complete bool, destAddrPort string, destIP string, destPort int, srcIP string) bool {
+	h.stats.IncHttpRequests()
+	if h.config.Load().EnableFirewallUABypass {
+		h.fwManager.ReportHttpEvent(destIP, destPort)
+	}
+
+	out, uaFound, bodyLen, drop := h.rewriteRawHeader(raw, destAddrPort, destIP, destPort, srcIP)
+	if drop {
+		return false
+	}
+	if uaFound {
+		h.stats.IncHttpFallbackRewrites()
+		logrus.Debugf("[Handler] [%s] Tolerant header rewrite applied", destAddrPort)
+	} else {
+		out = raw
+		h.stats.IncHttpFallbackRaw()
+		logrus.Debugf("[Handler] [%s] No User-Agent found in unparsable request, forwarding unchanged", destAddrPort)
+	}
+
+	rawLen := len(raw)
+	if _, err := dstWriter.Write(out); err != nil {
+		logrus.Debugf("[Handler] [%s] Fallback write error: %v", destAddrPort, err)
+		return false
+	}
+	if !complete {
+		// raw 指向 srcReader 的缓冲区，写出后才能消费
+		srcReader.Discard(rawLen)
+	}
+
+	if complete && bodyLen >= 0 {
+		// 请求边界可确定，转发 body 后继续处理下一个请求
+		if _, err := io.CopyN(dstWriter, srcReader, bodyLen); err != nil {
+			logrus.Debugf("[Handler] [%s] Fallback body copy error: %v", destAddrPort, err)
+			return false
+		}
+		if err := dstWriter.Flush(); err != nil {
+			logrus.Debugf("[Handler] [%s] Flush error after fallback request: %v", destAddrPort, err)
+			return false
+		}
+		return true
+	}
+
+	// 无法确定请求边界，剩余数据原样转发
+	if err := dstWriter.Flush(); err != nil {
+		logrus.Debugf("[Handler] [%s] Flush error before fallback: %v", destAddrPort, err)
+		return false
+	}
+	if _, err := h.Relay(dst, src, srcReader); err != nil && err != io.EOF {
+		logrus.Debugf("[Handler] [%s] Fallback copy error: %v", destAddrPort, err)
+	}
+	return false
+}
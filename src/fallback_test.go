@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestRewriteRawHeaderBodyLen(t *testing.T) {
+	h := newTestHandler(t, "-u", "Masked-UA", "-force")
+	tests := []struct {
+		name   string
+		header string
+		want   int64
+	}{
+		{"none", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", 0},
+		{"single", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\n", 5},
+		{"duplicate equal", "POST / HTTP/1.1\r\nContent-Length: 5\r\ncontent-length: 5\r\n\r\n", 5},
+		{"duplicate mismatch", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 7\r\n\r\n", -1},
+		{"zero then non-zero", "POST / HTTP/1.1\r\nContent-Length: 0\r\nContent-Length: 7\r\n\r\n", -1},
+		{"non-zero then zero", "POST / HTTP/1.1\r\nContent-Length: 7\r\nContent-Length: 0\r\n\r\n", -1},
+		{"invalid", "POST / HTTP/1.1\r\nContent-Length: x\r\n\r\n", -1},
+		{"chunked", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, bodyLen, _ := h.rewriteRawHeader([]byte(tt.header), "192.0.2.1:80", "192.0.2.1", 80, "")
+			if bodyLen != tt.want {
+				t.Errorf("bodyLen = %d, want %d", bodyLen, tt.want)
+			}
+		})
+	}
+}
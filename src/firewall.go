@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 与 init 脚本保持一致的规则名称
+const (
+	fwConfigName        = "UAmask"                // 防火墙 UCI include 名称
+	fwNftPath           = "/tmp/UAmask_rules.nft" // nft 规则文件
+	fwNftPreroutingName = "UAmask_prerouting_before"
+	fwNftOutputName     = "UAmask_output_after"
+	fwIptPreroutingName = "UAmask_prerouting"
+	fwIptOutputName     = "UAmask_output"
+	fwOpenClashGID      = 65534 // 同时豁免 OpenClash 的流量，防止循环
+)
+
+var fwIfacePattern = regexp.MustCompile(`^[A-Za-z0-9_.@+-]+$`)
+
+// fwCommand 是一条待执行的外部命令
+type fwCommand struct {
+	args        []string
+	ignoreError bool // 清理类命令允许失败
+	repeat      bool // 重复执行直到失败 (删除所有跳转规则)
+	createSet   bool // 创建 set，失败时改为执行 withoutSet
+}
+
+// firewallPlan 是一次 apply / remove 的完整操作：nft 规则文件与需要执行的命令
+type firewallPlan struct {
+	nftRuleset string // 仅 nft apply
+	commands   []fwCommand
+	withoutSet *firewallPlan // 无法创建 set 时改用的不引用 set 的规则
+}
+
+func (p *firewallPlan) add(ignoreError bool, args ...string) {
+	p.commands = append(p.commands, fwCommand{args: args, ignoreError: ignoreError})
+}
+
+// addCreateSet 添加创建 set 的命令，之后的规则才能引用该 set
+func (p *firewallPlan) addCreateSet(args ...string) {
+	p.commands = append(p.commands, fwCommand{args: args, createSet: true})
+}
+
+// Print 输出规则文件与命令 (shell 语法)，用于审阅与对比
+func (p *firewallPlan) Print(w io.Writer) {
+	if p.nftRuleset != "" {
+		fmt.Fprintf(w, "# %s\n%s\n", fwNftPath, p.nftRuleset)
+	}
+	for _, c := range p.commands {
+		quoted := make([]string, len(c.args))
+		for i, a := range c.args {
+			quoted[i] = shellQuote(a)
+		}
+		line := strings.Join(quoted, " ")
+		switch {
+		case c.repeat:
+			line = "while " + line + " 2>/dev/null; do :; done"
+		case c.ignoreError:
+			line += " 2>/dev/null || true"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// Execute 写入规则文件并依次执行命令，返回失败的命令数
+func (p *firewallPlan) Execute() int {
+	failed := 0
+	if p.nftRuleset != "" {
+		if err := os.WriteFile(fwNftPath, []byte(p.nftRuleset), 0644); err != nil {
+			logrus.Errorf("[Firewall] Failed to write %s: %v", fwNftPath, err)
+			return 1
+		}
+		logrus.Infof("[Firewall] Generated nftables rules at %s", fwNftPath)
+	}
+	for _, c := range p.commands {
+		for {
+			out, err := exec.Command(c.args[0], c.args[1:]...).CombinedOutput()
+			if c.repeat {
+				if err != nil {
+					break
+				}
+				continue
+			}
+			if err != nil && c.createSet && p.withoutSet != nil {
+				logrus.Errorf("[Firewall] Failed to create set: %s: %v %s. Domain bypass disabled.", strings.Join(c.args, " "), err, strings.TrimSpace(string(out)))
+				return failed + p.withoutSet.Execute()
+			}
+			if err != nil && !c.ignoreError {
+				failed++
+				logrus.Warnf("[Firewall] %s failed: %v %s", strings.Join(c.args, " "), err, strings.TrimSpace(string(out)))
+			}
+			break
+		}
+	}
+	return failed
+}
+
+// shellQuote 按需为参数加单引号
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,@", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// validateFirewallConfig 校验会写入规则的参数，避免生成无效或被注入的规则
+func validateFirewallConfig(cfg *Config) error {
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", cfg.Port)
+	}
+	if cfg.FirewallBypassGID < 0 {
+		return fmt.Errorf("invalid bypass gid: %d", cfg.FirewallBypassGID)
+	}
+	if len(cfg.FirewallIfaces) == 0 {
+		return fmt.Errorf("no interface configured")
+	}
+	for _, iface := range cfg.FirewallIfaces {
+		if !fwIfacePattern.MatchString(iface) {
+			return fmt.Errorf("invalid interface name: %q", iface)
+		}
+	}
+	for _, ip := range cfg.FirewallBypassIPs {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return fmt.Errorf("invalid bypass IP: %q", ip)
+			}
+		}
+	}
+	for _, port := range cfg.FirewallBypassPorts {
+		bounds := strings.SplitN(port, "-", 2)
+		for _, p := range bounds {
+			if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("invalid bypass port: %q", port)
+			}
+		}
+	}
+	if cfg.FirewallType != "nft" && cfg.FirewallType != "ipt" {
+		return fmt.Errorf("invalid firewall type: %q", cfg.FirewallType)
+	}
+	return nil
+}
+
+// nftIfaces 将接口列表格式化为 nft 表达式，单个接口时不加花括号
+func nftIfaces(ifaces []string) string {
+	quoted := make([]string, len(ifaces))
+	for i, iface := range ifaces {
+		quoted[i] = `"` + iface + `"`
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return "{ " + strings.Join(quoted, ", ") + " }"
+}
+
+// buildNftRuleset 生成 fw4 include 规则文件 (表内的 chain 定义)
+func buildNftRuleset(cfg *Config, setEnabled bool) string {
+	var b strings.Builder
+	ifaces := nftIfaces(cfg.FirewallIfaces)
+
+	// 豁免目标 IP 与端口
+	var bypass string
+	if len(cfg.FirewallBypassIPs) > 0 {
+		bypass += " ip daddr != { " + strings.Join(cfg.FirewallBypassIPs, ", ") + " }"
+	}
+	if len(cfg.FirewallBypassPorts) > 0 {
+		bypass += " tcp dport != { " + strings.Join(cfg.FirewallBypassPorts, ", ") + " }"
+	}
+
+	fmt.Fprintf(&b, "chain %s {\n", fwNftPreroutingName)
+	b.WriteString("    type nat hook prerouting priority dstnat - 1;\n\n")
+	if setEnabled {
+		fmt.Fprintf(&b, "    iifname %s ip protocol tcp ip daddr . tcp dport @%s return\n", ifaces, cfg.FirewallIPSetName)
+	}
+	fmt.Fprintf(&b, "    iifname %s ip protocol tcp%s redirect to :%d\n", ifaces, bypass, cfg.Port)
+	b.WriteString("}\n")
+
+	if cfg.ProxyHost {
+		fmt.Fprintf(&b, "\nchain %s {\n", fwNftOutputName)
+		b.WriteString("    type nat hook output priority -100;\n\n")
+		if setEnabled {
+			fmt.Fprintf(&b, "    ip protocol tcp ip daddr . tcp dport @%s return\n", cfg.FirewallIPSetName)
+		}
+		// 豁免 UAmask 自己 (bypass GID) 与 OpenClash 的流量
+		fmt.Fprintf(&b, "    ip protocol tcp%s meta skgid != { %d, %d } redirect to :%d\n", bypass, cfg.FirewallBypassGID, fwOpenClashGID, cfg.Port)
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// nftRemovePlan 删除 include、规则文件、链与 set
+func nftRemovePlan(cfg *Config) *firewallPlan {
+	p := &firewallPlan{}
+	p.add(true, "rm", "-f", fwNftPath)
+	p.add(true, "uci", "-q", "delete", "firewall."+fwConfigName)
+	p.add(true, "uci", "commit", "firewall")
+	p.add(true, "nft", "delete", "chain", "inet", "fw4", fwNftPreroutingName)
+	p.add(true, "nft", "delete", "chain", "inet", "fw4", fwNftOutputName)
+	p.add(true, "nft", "delete", "set", "inet", "fw4", cfg.FirewallIPSetName)
+	p.add(true, "fw4", "reload")
+	return p
+}
+
+// nftApplyPlan 生成规则文件并重新注册为 fw4 include
+// 启用 set 时先创建 set (规则加载时引用的 set 必须已存在)，创建失败则改用不引用 set 的规则
+func nftApplyPlan(cfg *Config, setEnabled bool) *firewallPlan {
+	p := &firewallPlan{nftRuleset: buildNftRuleset(cfg, setEnabled)}
+	if setEnabled {
+		p.addCreateSet("nft", "add", "set", "inet", "fw4", cfg.FirewallIPSetName, "{ type ipv4_addr . inet_service ; timeout 10m ;}")
+		p.withoutSet = nftApplyPlan(cfg, false)
+	}
+	p.add(true, "uci", "-q", "delete", "firewall."+fwConfigName)
+	p.add(false, "uci", "set", "firewall."+fwConfigName+"=include")
+	p.add(false, "uci", "set", "firewall."+fwConfigName+".type=nftables")
+	p.add(false, "uci", "set", "firewall."+fwConfigName+".path="+fwNftPath)
+	p.add(false, "uci", "set", "firewall."+fwConfigName+".enabled=1")
+	p.add(false, "uci", "commit", "firewall")
+	p.add(true, "nft", "delete", "chain", "inet", "fw4", fwNftPreroutingName)
+	p.add(true, "nft", "delete", "chain", "inet", "fw4", fwNftOutputName)
+	p.add(true, "fw4", "reload")
+	return p
+}
+
+// iptRemovePlan 删除跳转规则、自定义链与 ipset
+func iptRemovePlan(cfg *Config) *firewallPlan {
+	p := &firewallPlan{}
+	p.commands = append(p.commands,
+		fwCommand{args: []string{"iptables", "-t", "nat", "-D", "PREROUTING", "-j", fwIptPreroutingName}, repeat: true},
+		fwCommand{args: []string{"iptables", "-t", "nat", "-D", "OUTPUT", "-j", fwIptOutputName}, repeat: true},
+	)
+	for _, chain := range []string{fwIptPreroutingName, fwIptOutputName} {
+		p.add(true, "iptables", "-t", "nat", "-F", chain)
+		p.add(true, "iptables", "-t", "nat", "-X", chain)
+	}
+	p.add(true, "ipset", "destroy", cfg.FirewallIPSetName)
+	p.add(true, "/etc/init.d/firewall", "reload")
+	return p
+}
+
+// iptApplyPlan 先清理旧规则，再创建自定义链并挂载到 nat 表
+// 启用 set 时 ipset 创建失败 (如未安装 ipset) 则改用不引用 set 的规则
+func iptApplyPlan(cfg *Config, setEnabled bool) *firewallPlan {
+	p := iptRemovePlan(cfg)
+	port := strconv.Itoa(cfg.Port)
+	ipt := func(args ...string) {
+		p.add(false, append([]string{"iptables", "-t", "nat"}, args...)...)
+	}
+	var multiport string
+	if len(cfg.FirewallBypassPorts) > 0 {
+		multiport = strings.ReplaceAll(strings.Join(cfg.FirewallBypassPorts, ","), "-", ":")
+	}
+
+	if setEnabled {
+		p.addCreateSet("ipset", "create", cfg.FirewallIPSetName, "hash:ip,port", "timeout", "600", "-exist")
+		p.withoutSet = iptApplyPlan(cfg, false)
+	}
+	ipt("-N", fwIptPreroutingName)
+	ipt("-N", fwIptOutputName)
+	if setEnabled {
+		ipt("-A", fwIptPreroutingName, "-m", "set", "--match-set", cfg.FirewallIPSetName, "dst,dst", "-j", "RETURN")
+	}
+
+	// PREROUTING：按接口豁免目标 IP / 端口，其余 TCP 重定向到代理端口
+	for _, iface := range cfg.FirewallIfaces {
+		for _, ip := range cfg.FirewallBypassIPs {
+			ipt("-A", fwIptPreroutingName, "-i", iface, "-p", "tcp", "-d", ip, "-j", "RETURN")
+		}
+		if multiport != "" {
+			ipt("-A", fwIptPreroutingName, "-i", iface, "-p", "tcp", "-m", "multiport", "--dports", multiport, "-j", "RETURN")
+		}
+		ipt("-A", fwIptPreroutingName, "-i", iface, "-p", "tcp", "-j", "REDIRECT", "--to-port", port)
+	}
+
+	// OUTPUT：代理本机流量
+	if cfg.ProxyHost {
+		if setEnabled {
+			ipt("-A", fwIptOutputName, "-m", "set", "--match-set", cfg.FirewallIPSetName, "dst", "-j", "RETURN")
+		}
+		ipt("-A", fwIptOutputName, "-p", "tcp", "-m", "owner", "--gid-owner", strconv.Itoa(cfg.FirewallBypassGID), "-j", "RETURN")
+		ipt("-A", fwIptOutputName, "-p", "tcp", "-m", "owner", "--gid-owner", strconv.Itoa(fwOpenClashGID), "-j", "RETURN")
+		for _, ip := range cfg.FirewallBypassIPs {
+			ipt("-A", fwIptOutputName, "-p", "tcp", "-d", ip, "-j", "RETURN")
+		}
+		if multiport != "" {
+			ipt("-A", fwIptOutputName, "-p", "tcp", "-m", "multiport", "--dports", multiport, "-j", "RETURN")
+		}
+		ipt("-A", fwIptOutputName, "-p", "tcp", "-j", "REDIRECT", "--to-port", port)
+		ipt("-I", "OUTPUT", "1", "-j", fwIptOutputName)
+	}
+
+	ipt("-I", "PREROUTING", "1", "-j", fwIptPreroutingName)
+	return p
+}
+
+// runFirewallCommand 实现 "UAmask fw apply|remove [--print] [flags]" 子命令
+func runFirewallCommand(args []string) int {
+	usage := "usage: UAmask fw apply|remove [--print] [-config /etc/config/UAmask] [flags]"
+	if len(args) == 0 || (args[0] != "apply" && args[0] != "remove") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	action := args[0]
+
+	printOnly := false
+	flagArgs := make([]string, 0, len(args))
+	for _, a := range args[1:] {
+		if a == "--print" || a == "-print" {
+			printOnly = true
+			continue
+		}
+		flagArgs = append(flagArgs, a)
+	}
+
+	cfg, err := newFirewallConfig(flagArgs)
+	switch {
+	case err != nil:
+	case action == "apply":
+		err = validateFirewallConfig(cfg)
+	case cfg.FirewallType != "nft" && cfg.FirewallType != "ipt":
+		// 清理只用到防火墙类型与 set 名称
+		err = fmt.Errorf("invalid firewall type: %q", cfg.FirewallType)
+	}
+	if err != nil {
+		if action == "apply" {
+			fmt.Fprintf(os.Stderr, "fw %s: %v\n", action, err)
+			return 2
+		}
+		// 清理不能因配置错误而失败：按默认名称与检测到的防火墙类型删除
+		fmt.Fprintf(os.Stderr, "fw %s: %v, removing rules with default settings\n", action, err)
+		cfg = defaultFirewallConfig()
+	}
+	setupLogging(cfg.LogLevel, "")
+
+	// 打印与执行的是同一个计划，init 脚本据此判断规则是否变化
+	var plan *firewallPlan
+	switch {
+	case action == "remove" && cfg.FirewallType == "nft":
+		plan = nftRemovePlan(cfg)
+	case action == "remove":
+		plan = iptRemovePlan(cfg)
+	case cfg.FirewallType == "nft":
+		plan = nftApplyPlan(cfg, cfg.EnableFirewallSet)
+	default:
+		plan = iptApplyPlan(cfg, cfg.EnableFirewallSet)
+	}
+
+	if printOnly {
+		plan.Print(os.Stdout)
+		return 0
+	}
+	if failed := plan.Execute(); failed > 0 {
+		logrus.Errorf("[Firewall] %s (%s): %d commands failed", action, cfg.FirewallType, failed)
+		return 1
+	}
+	logrus.Infof("[Firewall] Firewall rules %s (%s)", map[string]string{"apply": "applied", "remove": "removed"}[action], cfg.FirewallType)
+	return 0
+}
+
+// defaultFirewallConfig 返回与 UCI 配置默认值一致的清理参数
+func defaultFirewallConfig() *Config {
+	return &Config{
+		LogLevel:          "info",
+		FirewallType:      detectFirewallType(),
+		FirewallIPSetName: uciFirewallSetName,
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata/*.golden")
+
+// 生成规则使用的参数，覆盖多个接口、豁免地址与端口、set 与本机代理
+var firewallTestArgs = []string{
+	"-port", "12032",
+	"-fw-iface", "br-lan,wlan0",
+	"-fw-bypass-ips", "192.168.0.0/16,10.0.0.1",
+	"-fw-bypass-ports", "22,8000-8080",
+	"-fw-set",
+	"-proxy-host",
+}
+
+func TestFirewallPlanGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		plan func(cfg *Config) *firewallPlan
+	}{
+		{"nft_apply", func(cfg *Config) *firewallPlan { return nftApplyPlan(cfg, cfg.EnableFirewallSet) }},
+		{"nft_remove", nftRemovePlan},
+		{"ipt_apply", func(cfg *Config) *firewallPlan { return iptApplyPlan(cfg, cfg.EnableFirewallSet) }},
+		{"ipt_remove", iptRemovePlan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := newFirewallConfig(firewallTestArgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validateFirewallConfig(cfg); err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			tt.plan(cfg).Print(&got)
+
+			path := filepath.Join("testdata", tt.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(path, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("plan mismatch (run with -update to accept)\n--- got\n%s\n--- want\n%s", got.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestFirewallPlanWithoutSet(t *testing.T) {
+	cfg, err := newFirewallConfig(firewallTestArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, plan := range map[string]*firewallPlan{
+		"nft": nftApplyPlan(cfg, true),
+		"ipt": iptApplyPlan(cfg, true),
+	} {
+		// 创建 set 是计划中的一步，失败时改用不引用 set 的计划
+		created := false
+		for _, c := range plan.commands {
+			created = created || c.createSet
+		}
+		if !created || plan.withoutSet == nil {
+			t.Errorf("%s: set creation step missing", name)
+			continue
+		}
+		var out bytes.Buffer
+		plan.withoutSet.Print(&out)
+		if bytes.Contains(out.Bytes(), []byte("--match-set")) || bytes.Contains(out.Bytes(), []byte("@"+cfg.FirewallIPSetName)) {
+			t.Errorf("%s: fallback plan still references the set:\n%s", name, out.Bytes())
+		}
+	}
+}
+
+func TestFirewallCommandIgnoresUnrelatedOptions(t *testing.T) {
+	// 规则文件不存在、关键词模式无效：只影响代理本身，不影响防火墙规则
+	path := writeUCIConfig(t, `config 'UAmask' 'main'
+	option port '12032'
+	option iface 'br-lan'
+	option rules_file '/nonexistent/rules'
+	option match_mode 'bogus'
+`)
+	for _, action := range []string{"apply", "remove"} {
+		if code := runFirewallCommand([]string{action, "--print", "-config", path}); code != 0 {
+			t.Errorf("fw %s: exit code %d, want 0", action, code)
+		}
+	}
+}
+
+func TestFirewallRemoveWithBrokenConfig(t *testing.T) {
+	path := writeUCIConfig(t, `config 'UAmask' 'main'
+	option port 'not-a-port'
+	option bypass_gid 'x'
+	option 'unterminated
+`)
+	if code := runFirewallCommand([]string{"apply", "--print", "-config", path}); code == 0 {
+		t.Error("fw apply: broken config accepted")
+	}
+	if code := runFirewallCommand([]string{"remove", "--print", "-config", path}); code != 0 {
+		t.Errorf("fw remove: exit code %d, want 0", code)
+	}
+	if code := runFirewallCommand([]string{"remove", "--print", "-config", filepath.Join(t.TempDir(), "missing")}); code != 0 {
+		t.Errorf("fw remove with missing config: exit code %d, want 0", code)
+	}
+}
+
+func writeUCIConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "UAmask")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
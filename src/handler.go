@@ -5,37 +5,46 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	HTTP_METHOD = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "TRACE", "CONNECT", "PATCH"}
-)
-
 type HTTPHandler struct {
-	config    *Config
+	config    atomic.Pointer[Config] // 可在运行时整体替换 (SIGHUP 重载)
 	stats     *Stats
-	cache     *lru.Cache[string, string]
+	cache     *lru.Cache[string, uaCacheEntry]
 	fwManager *FirewallSetManager
+	learned   *learnedWhitelist // 自动学习的临时白名单 (-learn-whitelist)
 
 	// bufio.Reader 池
 	bufioReaderPool sync.Pool
 	// bufio.Writer 池
 	bufioWriterPool sync.Pool
+	// 无法 splice 时使用的转发缓冲区池
+	copyBufPool sync.Pool
+}
+
+// uaCacheEntry 是 UA 缓存的值：默认匹配流程的结果与 UA 的解析结果
+type uaCacheEntry struct {
+	finalUA string  // 默认流程的最终 UA
+	decided bool    // finalUA 有效；只缓存了解析结果时为 false
+	info    *uaInfo // UA 解析结果 (-ua-stats、规则的字段条件)，未解析时为 nil
 }
 
-func NewHTTPHandler(config *Config, stats *Stats, cache *lru.Cache[string, string], fwManager *FirewallSetManager) *HTTPHandler {
+func NewHTTPHandler(config *Config, stats *Stats, cache *lru.Cache[string, uaCacheEntry], fwManager *FirewallSetManager) *HTTPHandler {
 	h := &HTTPHandler{
-		config:    config,
 		stats:     stats,
 		cache:     cache,
 		fwManager: fwManager,
+		learned:   newLearnedWhitelist(),
 	}
+	h.config.Store(config)
+	stats.SetLearnedSource(h.learned)
 
 	// 初始化 Reader 池
 	h.bufioReaderPool = sync.Pool{
@@ -49,44 +58,389 @@ func NewHTTPHandler(config *Config, stats *Stats, cache *lru.Cache[string, strin
 			return bufio.NewWriterSize(nil, config.BufferSize)
 		},
 	}
+	// 初始化转发缓冲区池
+	h.copyBufPool = sync.Pool{
+		New: func() any {
+			buf := make([]byte, config.BufferSize)
+			return &buf
+		},
+	}
 
 	return h
 }
 
-// peek HTTP
-func (h *HTTPHandler) isHTTP(reader *bufio.Reader) (bool, error) {
-	buf, err := reader.Peek(7)
-	if err != nil {
-		if strings.Contains(err.Error(), "EOF") {
-		} else {
-			logrus.Debugf("[Handler] Peek error: %s", err.Error())
-		}
-		return false, err
+// ApplyConfig 替换运行中的配置，新请求立即使用新配置
+// 匹配规则变化时清空 UA 缓存，缓存大小变化时调整容量
+func (h *HTTPHandler) ApplyConfig(config *Config) {
+	old := h.config.Swap(config)
+	if old.CacheSize != config.CacheSize {
+		evicted := h.cache.Resize(config.CacheSize)
+		logrus.Infof("[Handler] UA cache resized to %d (%d entries evicted)", config.CacheSize, evicted)
 	}
-	hint := string(buf)
-	is_http := false
-	for _, v := range HTTP_METHOD {
-		if strings.HasPrefix(hint, v) {
-			is_http = true
-			break
-		}
+	if old.rulesChanged(config) {
+		h.cache.Purge()
+		logrus.Info("[Handler] Matching rules changed, UA cache purged")
 	}
-	return is_http, nil
 }
 
 // 构造新 User-Agent 字符串
-func (h *HTTPHandler) buildNewUA(originUA string, replacementUA string, uaRegexp *regexp.Regexp, enablePartialReplace bool) string {
+func (h *HTTPHandler) buildNewUA(originUA string, replacementUA string, uaRegexp uaPattern, enablePartialReplace bool) (string, error) {
 	if enablePartialReplace && uaRegexp != nil {
 		// 启用部分替换：使用正则替换
-		newUaHearder := uaRegexp.ReplaceAllString(originUA, replacementUA)
-		return newUaHearder
+		return uaRegexp.ReplaceAllString(originUA, replacementUA)
 	}
 	// 默认完整替换
-	return replacementUA
+	return replacementUA, nil
+}
+
+// Relay 将 src 的剩余数据原样转发到 dst
+// 先写出 srcReader 中已缓冲的字节，再把原始 *net.TCPConn 交给 io.Copy，由内核 splice(2) 零拷贝转发；
+// 无法 splice 时使用池化缓冲区，避免每个连接分配 32 KiB
+func (h *HTTPHandler) Relay(dst net.Conn, src net.Conn, srcReader *bufio.Reader) (int64, error) {
+	var written int64
+	if srcReader != nil && srcReader.Buffered() > 0 {
+		buf, _ := srcReader.Peek(srcReader.Buffered())
+		n, err := dst.Write(buf)
+		written += int64(n)
+		srcReader.Discard(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if dstTCP, ok := dst.(*net.TCPConn); ok {
+		if srcTCP, ok := src.(*net.TCPConn); ok {
+			n, err := dstTCP.ReadFrom(srcTCP)
+			return written + n, err
+		}
+	}
+
+	bufPtr := h.copyBufPool.Get().(*[]byte)
+	defer h.copyBufPool.Put(bufPtr)
+	// 隐藏 ReaderFrom/WriterTo，确保使用池化缓冲区
+	n, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bufPtr)
+	return written + n, err
+}
+
+// tunnelVerdictWait 是 Upgrade / CONNECT 之后收到非 HTTP 数据时等待服务器响应的最长时间
+const tunnelVerdictWait = 5 * time.Second
+
+// tunnelEstablished 在 Upgrade / CONNECT 请求之后收到非 HTTP 数据时判断隧道是否已建立
+// 以服务器的响应为准 (101，或 CONNECT 的 2xx)；响应方向已停止配对或等待超时时无法得知结果，
+// 此时按客户端发送了非 HTTP 数据推断隧道已建立 —— 若服务器实际拒绝了升级，
+// 后续的非 HTTP 数据会被原样转发，不再进行深度扫描或上报
+func (h *HTTPHandler) tunnelEstablished(tracker *responseTracker, destAddrPort string) bool {
+	switch tracker.TunnelResult(tunnelVerdictWait) {
+	case tunnelOpen:
+		return true
+	case tunnelRefused:
+		logrus.Debugf("[Handler] [%s] Upgrade/CONNECT refused by server, treating data as non-HTTP", destAddrPort)
+		return false
+	}
+	logrus.Debugf("[Handler] [%s] Upgrade/CONNECT response unknown, assuming tunnel", destAddrPort)
+	return true
+}
+
+// isUpgradeRequest 判断请求是否要求协议升级 (如 WebSocket、h2c)
+func isUpgradeRequest(request *http.Request) bool {
+	if request.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range request.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flushOnReadBody 在首次读取 body 前刷新写缓冲区，用于 Expect: 100-continue
+type flushOnReadBody struct {
+	io.ReadCloser
+	w       *bufio.Writer
+	flushed bool
+}
+
+func (b *flushOnReadBody) Read(p []byte) (int, error) {
+	if !b.flushed {
+		b.flushed = true
+		if err := b.w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// uaDecision 是一次 User-Agent 匹配的结果
+type uaDecision struct {
+	finalUA string // 最终 UA，不修改时与原 UA 相同
+	drop    bool   // 命中防火墙白名单且需要断开连接
+	offload bool   // 已提交防火墙卸载
+	rule    string // 命中的规则名
+}
+
+// processUA 对 UA 依次执行缓存查询、白名单和规则匹配，返回最终 UA
+// HTTP 与 RTSP/SIP 等文本协议共用此流程；审计模式 (-audit) 下只记录决策，UA 与连接保持不变
+func (h *HTTPHandler) processUA(uaStr string, destAddrPort string, destIP string, destPort int, srcIP string, host string) uaDecision {
+	// 整个匹配过程使用同一份配置，重载不影响进行中的匹配
+	config := h.config.Load()
+	decision := h.decideUA(config, uaStr, destAddrPort, destIP, destPort, srcIP, host)
+	if config.Audit {
+		return h.auditDecision(decision, uaStr, destAddrPort)
+	}
+	if decision.finalUA != uaStr {
+		h.stats.IncModifiedRequests()
+	}
+	return decision
+}
+
+// auditDecision 记录本应执行的决策，返回不修改、不断开的结果
+func (h *HTTPHandler) auditDecision(decision uaDecision, uaStr string, destAddrPort string) uaDecision {
+	rule := ""
+	if decision.rule != "" {
+		rule = " (rule " + decision.rule + ")"
+	}
+	if decision.offload {
+		logrus.Infof("[Audit] [%s] Would offload connection%s: %s", destAddrPort, rule, uaStr)
+	}
+	if decision.drop {
+		h.stats.IncAuditDrops()
+		logrus.Infof("[Audit] [%s] Would drop connection%s: %s", destAddrPort, rule, uaStr)
+	} else if decision.finalUA != uaStr {
+		h.stats.IncAuditModified()
+		logrus.Infof("[Audit] [%s] Would modify UA%s: %s -> %s", destAddrPort, rule, uaStr, decision.finalUA)
+	}
+	return uaDecision{finalUA: uaStr}
+}
+
+// regexAborted 处理正则匹配超时：本次不修改 UA，也不缓存结果 (超时不等于不匹配)
+func (h *HTTPHandler) regexAborted(destAddrPort string, uaStr string, err error) uaDecision {
+	h.stats.IncRegexTimeouts()
+	logrus.Warnf("[Handler] [%s] Regex match aborted (%v), forwarding UA unchanged without caching: %s", destAddrPort, err, uaStr)
+	return uaDecision{finalUA: uaStr}
+}
+
+// decideUA 是 processUA 的匹配流程，firewall 动作在审计模式下由 FirewallSetManager 空跑
+func (h *HTTPHandler) decideUA(config *Config, uaStr string, destAddrPort string, destIP string, destPort int, srcIP string, host string) uaDecision {
+	// Host 映射决定替换 UA，存在映射时缓存键包含命中的域名规则
+	cacheKey := uaStr
+	var hostRule *hostEntry
+	if config.HostMap != nil {
+		hostRule = config.HostMap.Lookup(host)
+		if hostRule != nil {
+			cacheKey = hostRule.class + "\x00" + uaStr
+		} else {
+			cacheKey = "\x00" + uaStr
+		}
+	}
+	replacementUA := config.UserAgent
+	if hostRule != nil && !hostRule.pass {
+		replacementUA = hostRule.ua
+	}
+
+	// UA 统计覆盖所有请求 (包括之后命中学习白名单与规则的)，解析结果随缓存保存
+	entry, _ := h.cache.Get(cacheKey)
+	if config.UAStats {
+		if entry.info == nil {
+			info := parseUA(uaStr)
+			entry.info = &info
+			h.cache.Add(cacheKey, entry)
+		}
+		h.stats.IncUAInfo(*entry.info)
+	}
+
+	// 学习到的白名单最先检查：服务器拒绝的是修改后的 UA，规则文件的改写同样会被拒绝，
+	// 因此命中时规则 (包括 drop / offload) 不再生效；缓存中也可能是学习之前修改过的 UA
+	if config.LearnWhitelist && h.learned.Contains(host) {
+		logrus.Debugf("[Handler] [%s] Hit Learned Whitelist (%s): %s", destAddrPort, host, uaStr)
+		return uaDecision{finalUA: uaStr}
+	}
+
+	// 0. 规则文件按顺序匹配，命中后不再走缓存与默认流程 (规则可能依赖 Host、地址等)
+	if len(config.Rules) > 0 {
+		req := &ruleRequest{ua: uaStr, host: host, srcIP: net.ParseIP(srcIP), dstIP: net.ParseIP(destIP), dstPort: destPort, info: entry.info}
+		rule, err := MatchRules(config.Rules, req)
+		if err != nil {
+			return h.regexAborted(destAddrPort, uaStr, err)
+		}
+		if entry.info == nil && req.info != nil {
+			// 字段条件解析过 UA
+			entry.info = req.info
+			h.cache.Add(cacheKey, entry)
+		}
+		if rule != nil {
+			return h.applyRule(config, rule, uaStr, destAddrPort, destIP, destPort)
+		}
+	}
+
+	if entry.decided {
+		// UA 缓存
+		finalUA := entry.finalUA
+		if finalUA != uaStr {
+			h.stats.IncCacheHits()
+			logrus.Debugf("[Handler] [%s] UA modified (cached): %s -> %s", destAddrPort, uaStr, finalUA)
+		} else {
+			h.stats.IncCacheHitNoModify()
+			logrus.Debugf("[Handler] [%s] UA not modified (cached): %s", destAddrPort, uaStr)
+		}
+		return uaDecision{finalUA: finalUA}
+	}
+
+	// 未命中缓存
+	var shouldReplace bool
+	var matchReason string
+
+	// 1. 检查白名单 (最高优先级)
+	fwKeyword, isFirewallWhitelisted := config.FirewallUAMatcher.Match(uaStr)
+	if isFirewallWhitelisted {
+		logrus.Debugf("[Handler] [%s] Hit Firewall UA Whitelist (%s): %s", destAddrPort, fwKeyword, uaStr)
+		h.fwManager.Add(destIP, destPort, config.FirewallIPSetName, config.FirewallType, 86400)
+		if config.FirewallDropOnMatch {
+			logrus.Debugf("[Handler] [%s] FirewallDropOnMatch enabled, dropping connection for protocol switch bypass.", destAddrPort)
+			return uaDecision{finalUA: uaStr, drop: true, offload: true}
+		}
+		shouldReplace = false
+		matchReason = "Hit Firewall UA Whitelist (" + fwKeyword + ")"
+
+	} else {
+		entry, whitelisted, err := config.WhitelistMatcher.Match(uaStr)
+		if err != nil {
+			return h.regexAborted(destAddrPort, uaStr, err)
+		}
+		if whitelisted {
+			shouldReplace = false
+			matchReason = "Hit User-Agent Whitelist (" + entry + ")"
+		} else if hostRule != nil && hostRule.pass {
+			shouldReplace = false
+			matchReason = "Hit Host Map Pass (" + hostRule.class + ")"
+		} else {
+			// 2. 根据模式进行匹配 (使用当前配置)
+			if config.ForceReplace {
+				// 强制模式
+				shouldReplace = true
+				matchReason = "Force Replace Mode"
+			} else if config.EnableRegex {
+				// 正则模式
+				matched := false
+				if config.UARegexp != nil {
+					matched, err = config.UARegexp.MatchString(uaStr)
+					if err != nil {
+						return h.regexAborted(destAddrPort, uaStr, err)
+					}
+				}
+				if matched {
+					shouldReplace = true
+					matchReason = "Hit User-Agent Pattern"
+				} else {
+					shouldReplace = false
+					matchReason = "Not Hit User-Agent Pattern"
+				}
+			} else {
+				// 默认：关键词模式
+				// 存在关键词专属的替换 UA 时按列表顺序取命中的关键词，结果与关键词在 UA 中的位置无关
+				match := config.KeywordMatcher.Match
+				if len(config.KeywordReplacements) > 0 {
+					match = config.KeywordMatcher.MatchByOrder
+				}
+				if keyword, ok := match(uaStr); ok {
+					shouldReplace = true
+					matchReason = "Hit User-Agent Keyword (" + keyword + ")"
+					// Host 映射优先于关键词专属的替换 UA
+					if ua, ok := config.KeywordReplacements[keyword]; ok && hostRule == nil {
+						replacementUA = ua
+					}
+				} else {
+					shouldReplace = false
+					matchReason = "Not Hit User-Agent Keywords"
+				}
+			}
+		}
+	}
+	// 3. 处理日志和缓存
+	if !shouldReplace {
+		logrus.Debugf("[Handler] [%s] %s: %s. ", destAddrPort, matchReason, uaStr)
+		if !isFirewallWhitelisted {
+			h.cache.Add(cacheKey, uaCacheEntry{finalUA: uaStr, decided: true, info: entry.info}) // 缓存不修改的UA
+		}
+		return uaDecision{finalUA: uaStr, offload: isFirewallWhitelisted}
+	}
+	logrus.Debugf("[Handler] [%s] %s: %s", destAddrPort, matchReason, uaStr)
+
+	// 调用 buildNewUA 来获取最终的 UA 字符串 (模板占位符取自原 UA，结果可以缓存)
+	replacementUA = expandUATemplate(replacementUA, uaStr)
+	finalUA, err := h.buildNewUA(uaStr, replacementUA, config.UARegexp, config.EnablePartialReplace)
+	if err != nil {
+		return h.regexAborted(destAddrPort, uaStr, err)
+	}
+
+	if !isFirewallWhitelisted {
+		h.cache.Add(cacheKey, uaCacheEntry{finalUA: finalUA, decided: true, info: entry.info}) // 缓存修改的UA
+	}
+
+	if config.ForceReplace {
+		logrus.Debugf("[Handler] [%s] UA modified (forced): %s -> %s", destAddrPort, uaStr, finalUA)
+	} else {
+		if config.EnablePartialReplace && finalUA != replacementUA {
+			logrus.Debugf("[Handler] [%s] UA partially modified: %s -> %s", destAddrPort, uaStr, finalUA)
+		} else {
+			logrus.Debugf("[Handler] [%s] UA fully modified: %s -> %s", destAddrPort, uaStr, finalUA)
+		}
+	}
+	return uaDecision{finalUA: finalUA}
+}
+
+// applyRule 执行命中规则的动作
+func (h *HTTPHandler) applyRule(config *Config, rule *Rule, uaStr string, destAddrPort string, destIP string, destPort int) uaDecision {
+	h.stats.IncRule(rule.Name)
+	decision := uaDecision{finalUA: uaStr, rule: rule.Name}
+	switch rule.Action {
+	case RuleActionReplace:
+		finalUA := rule.Replacement
+		if finalUA == "" {
+			finalUA = config.UserAgent
+		}
+		finalUA = expandUATemplate(finalUA, uaStr)
+		logrus.Debugf("[Handler] [%s] Hit rule %s, UA modified: %s -> %s", destAddrPort, rule.Name, uaStr, finalUA)
+		decision.finalUA = finalUA
+	case RuleActionOffload:
+		logrus.Debugf("[Handler] [%s] Hit rule %s, offloading: %s", destAddrPort, rule.Name, uaStr)
+		h.fwManager.Add(destIP, destPort, config.FirewallIPSetName, config.FirewallType, 86400)
+		decision.offload = true
+		decision.drop = config.FirewallDropOnMatch
+	case RuleActionDrop:
+		logrus.Debugf("[Handler] [%s] Hit rule %s, dropping connection: %s", destAddrPort, rule.Name, uaStr)
+		decision.drop = true
+	default:
+		logrus.Debugf("[Handler] [%s] Hit rule %s, UA not modified: %s", destAddrPort, rule.Name, uaStr)
+	}
+	return decision
+}
+
+// reportNonHttp 记录非 HTTP 连接，并按协议上报给防火墙管理器
+func (h *HTTPHandler) reportNonHttp(srcReader *bufio.Reader, proto Protocol, destAddrPort string, destIP string, destPort int) {
+	if proto == ProtoTLS {
+		// TLS 流量：ClientHello 仍在缓冲区中，解析 SNI/ALPN
+		hello, err := peekClientHello(srcReader)
+		if err == nil {
+			logrus.Debugf("[Handler] [%s] TLS ClientHello detected, SNI: %s, ALPN: %v", destAddrPort, hello.ServerName, hello.ALPN)
+			h.stats.IncTlsConnections(hello.ServerName)
+			if h.config.Load().EnableFirewallUABypass {
+				h.fwManager.ReportTlsEvent(destIP, destPort, hello.ServerName)
+			}
+			return
+		}
+		logrus.Debugf("[Handler] [%s] TLS ClientHello parse error: %v", destAddrPort, err)
+	}
+	if h.config.Load().EnableFirewallUABypass {
+		h.fwManager.ReportProtocolEvent(destIP, destPort, proto)
+	}
 }
 
 // ModifyAndForward 是核心处理函数，负责修改 User-Agent 并转发数据
-func (h *HTTPHandler) ModifyAndForward(dst net.Conn, src net.Conn, destAddrPort string, destIP string, destPort int) {
+// tracker 不为 nil 时记录每个转发的请求，供 RelayResponses 配对响应
+func (h *HTTPHandler) ModifyAndForward(dst net.Conn, src net.Conn, destAddrPort string, destIP string, destPort int, tracker *responseTracker) {
 	srcReader := h.bufioReaderPool.Get().(*bufio.Reader)
 	srcReader.Reset(src)
 	defer h.bufioReaderPool.Put(srcReader)
@@ -101,15 +455,25 @@ func (h *HTTPHandler) ModifyAndForward(dst net.Conn, src net.Conn, destAddrPort
 	}()
 
 	logrus.Debugf("[Handler] [%s] connection established", destAddrPort)
+	var srcIP string
+	if addr, ok := src.RemoteAddr().(*net.TCPAddr); ok {
+		srcIP = addr.IP.String()
+	}
 
+	firstMessage := true
+	// 上一个请求是 Upgrade 或 CONNECT：若客户端接着发送非 HTTP 数据，说明隧道已建立
+	tunnelPending := false
+	// 当前请求头的副本，ReadRequest 失败时用于回退
+	var headerBuf []byte
 	for {
-		is_http, err := h.isHTTP(srcReader)
+		proto, err := classifyProtocol(srcReader, src)
 		//检测失败
 		if err != nil {
 			if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
 				logrus.Debugf("[Handler] [%s] Connection closed (EOF or closed in loop)", destAddrPort)
 			} else {
-				logrus.Debugf("[Handler] [%s] isHTTP check in loop error: %v", destAddrPort, err)
+				logrus.Debugf("[Handler] [%s] Protocol classify in loop error: %v", destAddrPort, err)
+				tracker.Stop()
 			}
 
 			// 退出前尝试刷新剩余数据
@@ -117,40 +481,115 @@ func (h *HTTPHandler) ModifyAndForward(dst net.Conn, src net.Conn, destAddrPort
 				logrus.Debugf("[Handler] [%s] Flush error before fallback (isHTTP err): %v", destAddrPort, err_flush)
 			}
 			// 回退到io.copy
-			if _, err := io.Copy(dst, srcReader); err != nil && err != io.EOF {
+			if _, err := h.Relay(dst, src, srcReader); err != nil && err != io.EOF {
 				logrus.Debugf("[Handler] [%s] Fallback copy error: %v", destAddrPort, err)
 			}
 			return
 		}
 
-		if !is_http {
-			logrus.Debugf("[Handler] [%s] non-HTTP traffic detected", destAddrPort)
+		if firstMessage {
+			h.stats.IncProtocol(proto)
+			firstMessage = false
+		}
+
+		if proto == ProtoRTSP || proto == ProtoSIP {
+			tracker.Stop()
+			logrus.Debugf("[Handler] [%s] %s traffic detected", destAddrPort, proto)
+			err := h.forwardTextProtocol(proto, srcReader, dstWriter, destAddrPort, destIP, destPort, srcIP)
+			if err == errNotTextMessage {
+				// 无法继续解析，剩余数据原样转发
+				if err_flush := dstWriter.Flush(); err_flush != nil {
+					logrus.Debugf("[Handler] [%s] Flush error before fallback (%s): %v", destAddrPort, proto, err_flush)
+				}
+				if _, err := h.Relay(dst, src, srcReader); err != nil && err != io.EOF {
+					logrus.Debugf("[Handler] [%s] Fallback copy error: %v", destAddrPort, err)
+				}
+			} else if err != nil && err != io.EOF {
+				logrus.Debugf("[Handler] [%s] %s forward error: %v", destAddrPort, proto, err)
+			}
+			return
+		}
+
+		if proto != ProtoHTTP {
 			// 刷新已缓冲的数据
 			if err_flush := dstWriter.Flush(); err_flush != nil {
 				logrus.Debugf("[Handler] [%s] Flush error before fallback (isHTTP err): %v", destAddrPort, err_flush)
 			}
-			if h.config.EnableFirewallUABypass {
-				h.fwManager.ReportNonHttpEvent(destIP, destPort)
+			if tunnelPending && h.tunnelEstablished(tracker, destAddrPort) {
+				tracker.Stop()
+				// Upgrade / CONNECT 已生效，后续是隧道数据而不是非 HTTP 服务
+				logrus.Debugf("[Handler] [%s] Tunnel established (%s), switching to raw relay", destAddrPort, proto)
+				if _, err := h.Relay(dst, src, srcReader); err != nil && err != io.EOF {
+					logrus.Debugf("[Handler] [%s] Tunnel copy error: %v", destAddrPort, err)
+				}
+				return
+			}
+			tracker.Stop()
+			logrus.Debugf("[Handler] [%s] non-HTTP traffic detected (%s)", destAddrPort, proto)
+			if h.config.Load().DeepScanPorts[destPort] && proto != ProtoTLS {
+				// 深度扫描端口：不上报非 HTTP 事件，避免被卸载后泄露 UA
+				logrus.Debugf("[Handler] [%s] Deep scan enabled for %s stream", destAddrPort, proto)
+				if err := h.deepScanCopy(dst, src, srcReader, destAddrPort, destIP, destPort, srcIP); err != nil && err != io.EOF {
+					logrus.Debugf("[Handler] [%s] Deep scan copy error: %v", destAddrPort, err)
+				}
+				return
 			}
-			if _, err := io.Copy(dst, srcReader); err != nil && err != io.EOF {
+			h.reportNonHttp(srcReader, proto, destAddrPort, destIP, destPort)
+			if _, err := h.Relay(dst, src, srcReader); err != nil && err != io.EOF {
 				logrus.Debugf("[Handler] [%s] Fallback copy error: %v", destAddrPort, err)
 			}
 			return
 		}
 
-		// 3. 使用 Go 标准库解析 HTTP 头部
-		request, err := http.ReadRequest(srcReader)
-		if err != nil {
+		// 3. 先窥视完整请求头，解析失败时可以用原始数据回退
+		// 请求头超过缓冲区时仍交给 http.ReadRequest 解析，只是失败后无法回退
+		block, err := peekUntilFunc(srcReader, headerBlockEnd)
+		headerBuf = headerBuf[:0]
+		switch {
+		case err == nil:
+			headerBuf = append(headerBuf, block...)
+		case err == bufio.ErrBufferFull:
+			logrus.Debugf("[Handler] [%s] Request header exceeds buffer size (%d), tolerant fallback unavailable", destAddrPort, srcReader.Size())
+		default:
 			if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
 				logrus.Debugf("[Handler] [%s] Connection closed (EOF or closed)", destAddrPort)
 			} else if strings.Contains(err.Error(), "connection reset by peer") {
 				logrus.Debugf("[Handler] [%s] Connection reset", destAddrPort)
 			} else {
-				logrus.Debugf("[Handler] [%s] HTTP read request error: %v", destAddrPort, err)
+				logrus.Debugf("[Handler] [%s] HTTP read header error: %v", destAddrPort, err)
+			}
+			// 转发已缓冲的不完整数据
+			if err_flush := dstWriter.Flush(); err_flush == nil {
+				h.Relay(dst, src, srcReader)
 			}
 			return // 结束此连接的处理
 		}
-		if h.config.EnableFirewallUABypass {
+		buffered := srcReader.Buffered()
+
+		// 使用 Go 标准库解析 HTTP 头部
+		request, err := http.ReadRequest(srcReader)
+		if err != nil {
+			if len(headerBuf) == 0 {
+				// 请求头未完整缓冲，已消费的部分无法恢复
+				logrus.Debugf("[Handler] [%s] HTTP read request error: %v", destAddrPort, err)
+				return
+			}
+			logrus.Debugf("[Handler] [%s] HTTP read request error: %v, trying tolerant fallback", destAddrPort, err)
+			// 请求头已完整缓冲，解析过程中不会重新填充缓冲区，据此计算已消费的字节数
+			consumed := buffered - srcReader.Buffered()
+			if consumed < 0 || consumed > len(headerBuf) {
+				logrus.Debugf("[Handler] [%s] Cannot recover raw request (consumed %d of %d bytes)", destAddrPort, consumed, len(headerBuf))
+				return
+			}
+			srcReader.Discard(len(headerBuf) - consumed)
+			// 无法解析的请求之后不再配对响应
+			tracker.Stop()
+			if h.fallbackRawRequest(dst, src, dstWriter, srcReader, headerBuf, true, destAddrPort, destIP, destPort, srcIP) {
+				continue
+			}
+			return
+		}
+		if h.config.Load().EnableFirewallUABypass {
 			h.fwManager.ReportHttpEvent(destIP, destPort)
 		}
 
@@ -159,119 +598,40 @@ func (h *HTTPHandler) ModifyAndForward(dst net.Conn, src net.Conn, destAddrPort
 		// 4. 获取 User-Agent
 		uaStr := request.Header.Get("User-Agent")
 		uaFound := uaStr != ""
+		host := requestHost(request.Host)
+		modified := false
 
 		if !uaFound {
 			logrus.Debugf("[Handler] [%s] No User-Agent header, skip modification.", destAddrPort)
 		} else {
-			if finalUA, ok := h.cache.Get(uaStr); ok {
-				// UA 缓存
-				request.Header.Set("User-Agent", finalUA)
-				if finalUA != uaStr {
-					h.stats.IncCacheHits()
-					h.stats.IncModifiedRequests()
-					logrus.Debugf("[Handler] [%s] UA modified (cached): %s -> %s", destAddrPort, uaStr, finalUA)
-				} else {
-					h.stats.IncCacheHitNoModify()
-					logrus.Debugf("[Handler] [%s] UA not modified (cached): %s", destAddrPort, uaStr)
-				}
-			} else {
-				// 未命中缓存
-				var shouldReplace bool
-				var matchReason string
-
-				// 1. 检查白名单 (最高优先级)
-				isFirewallWhitelisted := false
-				if len(h.config.FirewallUAWhitelist) > 0 {
-					for _, fw_keyword := range h.config.FirewallUAWhitelist {
-						if strings.Contains(uaStr, fw_keyword) {
-							isFirewallWhitelisted = true
-							break
-						}
-					}
-				}
-				if isFirewallWhitelisted {
-					logrus.Debugf("[Handler] [%s] Hit Firewall UA Whitelist: %s", destAddrPort, uaStr)
-					h.fwManager.Add(destIP, destPort, h.config.FirewallIPSetName, h.config.FirewallType, 86400)
-					if h.config.FirewallDropOnMatch {
-						logrus.Debugf("[Handler] [%s] FirewallDropOnMatch enabled, dropping connection for protocol switch bypass.", destAddrPort)
-						return
-					}
-					shouldReplace = false
-					matchReason = "Hit Firewall UA Whitelist"
-
-				} else {
-					isInWhiteList := false
-					for _, v := range h.config.Whitelist {
-						if v == uaStr {
-							isInWhiteList = true
-							break
-						}
-					}
-
-					if isInWhiteList {
-						shouldReplace = false
-						matchReason = "Hit User-Agent Whitelist"
-					} else {
-						// 2. 根据模式进行匹配 (使用 h.config)
-						if h.config.ForceReplace {
-							// 强制模式
-							shouldReplace = true
-							matchReason = "Force Replace Mode"
-						} else if h.config.EnableRegex {
-							// 正则模式
-							if h.config.UARegexp != nil && h.config.UARegexp.MatchString(uaStr) {
-								shouldReplace = true
-								matchReason = "Hit User-Agent Pattern"
-							} else {
-								shouldReplace = false
-								matchReason = "Not Hit User-Agent Pattern"
-							}
-						} else {
-							// 默认：关键词模式
-							shouldReplace = false
-							matchReason = "Not Hit User-Agent Keywords"
-							for _, keyword := range h.config.KeywordsList {
-								if strings.Contains(uaStr, keyword) {
-									shouldReplace = true
-									matchReason = "Hit User-Agent Keyword"
-									break
-								}
-							}
-						}
-					}
-				}
-				// 3. 处理日志和缓存
-				if !shouldReplace {
-					logrus.Debugf("[Handler] [%s] %s: %s. ", destAddrPort, matchReason, uaStr)
-					if !isFirewallWhitelisted {
-						h.cache.Add(uaStr, uaStr) // 缓存不修改的UA
-					}
-				} else {
-					logrus.Debugf("[Handler] [%s] %s: %s", destAddrPort, matchReason, uaStr)
-				}
-
-				// 根据 shouldReplace 标志执行操作
-				if shouldReplace {
-					// 调用 buildNewUA 来获取最终的 UA 字符串
-					finalUA := h.buildNewUA(uaStr, h.config.UserAgent, h.config.UARegexp, h.config.EnablePartialReplace)
-
-					request.Header.Set("User-Agent", finalUA)
-					h.stats.IncModifiedRequests()
-					if !isFirewallWhitelisted {
-						h.cache.Add(uaStr, finalUA) // 缓存修改的UA
-					}
-
-					if h.config.ForceReplace {
-						logrus.Debugf("[Handler] [%s] UA modified (forced): %s -> %s", destAddrPort, uaStr, finalUA)
-					} else {
-						if h.config.EnablePartialReplace && finalUA != h.config.UserAgent {
-							logrus.Debugf("[Handler] [%s] UA partially modified: %s -> %s", destAddrPort, uaStr, finalUA)
-						} else {
-							logrus.Debugf("[Handler] [%s] UA fully modified: %s -> %s", destAddrPort, uaStr, finalUA)
-						}
-					}
-				}
+			decision := h.processUA(uaStr, destAddrPort, destIP, destPort, srcIP, host)
+			if decision.drop {
+				request.Body.Close()
+				return
 			}
+			request.Header.Set("User-Agent", decision.finalUA)
+			if decision.finalUA != uaStr {
+				modified = true
+				applyClientHints(request.Header, h.config.Load().ClientHints, decision.finalUA)
+			}
+		}
+		// 5. 协议升级与 100-continue
+		if tunnelPending {
+			logrus.Debugf("[Handler] [%s] HTTP request after Upgrade/CONNECT, continuing as HTTP", destAddrPort)
+		}
+		tunnelPending = request.Method == http.MethodConnect || isUpgradeRequest(request)
+		if h.config.Load().LearnWhitelist || tunnelPending {
+			tracker.Push(pendingRequest{host: host, method: request.Method, modified: modified, tunnel: tunnelPending})
+		} else {
+			// 不需要配对响应：响应方向停止解析，改为原样转发 (可以 splice)
+			tracker.Stop()
+		}
+		if tunnelPending {
+			logrus.Debugf("[Handler] [%s] %s request with Upgrade %q, expecting tunnel", destAddrPort, request.Method, request.Header.Get("Upgrade"))
+		}
+		if strings.EqualFold(request.Header.Get("Expect"), "100-continue") {
+			// 客户端要等到服务器返回 100 才发送 body，读取 body 前必须先把请求头发出去
+			request.Body = &flushOnReadBody{ReadCloser: request.Body, w: dstWriter}
 		}
 
 		// 6. 写回目标
@@ -280,11 +640,13 @@ func (h *HTTPHandler) ModifyAndForward(dst net.Conn, src net.Conn, destAddrPort
 			request.Body.Close()
 			return
 		}
-		// 7. 刷新缓冲区，确保请求头立即发送
-		if err := dstWriter.Flush(); err != nil {
-			logrus.Debugf("[Handler] [%s] Flush error after writing request: %v", destAddrPort, err)
-			request.Body.Close()
-			return
+		// 7. 刷新缓冲区，确保请求头立即发送；流水线中的后续请求已在缓冲区时合并发送
+		if srcReader.Buffered() == 0 || tunnelPending {
+			if err := dstWriter.Flush(); err != nil {
+				logrus.Debugf("[Handler] [%s] Flush error after writing request: %v", destAddrPort, err)
+				request.Body.Close()
+				return
+			}
 		}
 
 		// 8. 关闭 Body，准备读取下一个 Keep-Alive 请求
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+func newTestHandler(t *testing.T, args ...string) *HTTPHandler {
+	t.Helper()
+	cfg, err := NewConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := lru.New[string, uaCacheEntry](cfg.CacheSize)
+	return NewHTTPHandler(cfg, NewStats(), cache, nil)
+}
+
+// forwardRequests 把 input 作为客户端数据交给 ModifyAndForward，返回写往服务器的全部数据
+func forwardRequests(t *testing.T, h *HTTPHandler, input string) string {
+	t.Helper()
+	client, proxySrc := net.Pipe()
+	proxyDst, server := net.Pipe()
+	go func() {
+		client.Write([]byte(input))
+		client.Close()
+	}()
+	go func() {
+		h.ModifyAndForward(proxyDst, proxySrc, "192.0.2.1:80", "192.0.2.1", 80, nil)
+		proxyDst.Close()
+	}()
+	out, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestModifyAndForwardLargeHeader(t *testing.T) {
+	h := newTestHandler(t, "-u", "Masked-UA", "-force")
+	// 请求头超过 8 KiB 的缓冲区，User-Agent 位于缓冲区边界之后
+	large := "GET /a HTTP/1.1\r\nHost: example.com\r\n" +
+		"Cookie: " + strings.Repeat("c", 10000) + "\r\n" +
+		"User-Agent: Mozilla/5.0 (Windows NT 10.0)\r\n\r\n"
+	next := "GET /b HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0 (iPhone)\r\n\r\n"
+
+	out := forwardRequests(t, h, large+next)
+	reader := bufio.NewReader(strings.NewReader(out))
+	for _, path := range []string{"/a", "/b"} {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Fatalf("request %s: %v", path, err)
+		}
+		if req.URL.Path != path {
+			t.Errorf("got path %q, want %q", req.URL.Path, path)
+		}
+		if ua := req.Header.Get("User-Agent"); ua != "Masked-UA" {
+			t.Errorf("request %s: User-Agent %q, want %q", path, ua, "Masked-UA")
+		}
+	}
+	if strings.Contains(out, "Mozilla") {
+		t.Error("original User-Agent leaked")
+	}
+}
+
+func TestUAStatsCountsEveryRequest(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(rules, []byte("name=ios os=iOS replace Rule-UA\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, "-u", "Masked-UA", "-force", "-ua-stats", "-learn-whitelist", "-rules", rules)
+	h.learned.entries["learned.example"] = time.Now().Add(time.Hour)
+
+	iPhone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	windows := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0.0.0 Safari/537.36"
+	for _, tt := range []struct {
+		ua, host, want string
+	}{
+		{iPhone, "a.example", "Rule-UA"},      // 规则
+		{iPhone, "a.example", "Rule-UA"},      // 规则 (解析结果已缓存)
+		{windows, "learned.example", windows}, // 学习白名单
+		{windows, "a.example", "Masked-UA"},   // 默认流程
+		{windows, "a.example", "Masked-UA"},   // 缓存命中
+		{iPhone, "learned.example", iPhone},   // 学习白名单优先于规则
+	} {
+		if got := h.processUA(tt.ua, "192.0.2.1:80", "192.0.2.1", 80, "", tt.host).finalUA; got != tt.want {
+			t.Errorf("%s @ %s: got %q, want %q", tt.ua, tt.host, got, tt.want)
+		}
+	}
+
+	counts := map[string]uint64{}
+	for _, item := range h.stats.UAOS.Top(0) {
+		counts[item.Label] = item.Count
+	}
+	if counts["iOS"] != 3 || counts["Windows"] != 3 {
+		t.Errorf("ua_os counts = %v, want iOS:3 Windows:3", counts)
+	}
+	if entry, ok := h.cache.Peek(iPhone); !ok || entry.info == nil || entry.decided {
+		t.Errorf("parsed UA not cached for rule-matched request: %+v", entry)
+	}
+}
+
+func TestResponsePairingOnlyWhenNeeded(t *testing.T) {
+	plain := "GET / HTTP/1.1\r\nHost: a\r\nUser-Agent: x\r\n\r\n"
+	upgrade := "GET /ws HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nUser-Agent: x\r\n\r\n"
+	tests := []struct {
+		name    string
+		args    []string
+		input   string
+		pending int
+		stopped bool
+	}{
+		{"plain request", nil, plain, 0, true},
+		{"upgrade request", nil, upgrade, 1, false},
+		{"upgrade then plain", nil, upgrade + plain, 0, true},
+		{"learn whitelist", []string{"-learn-whitelist"}, plain + plain, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, tt.args...)
+			tracker := &responseTracker{}
+			client, proxySrc := net.Pipe()
+			proxyDst, server := net.Pipe()
+			go io.Copy(io.Discard, server)
+			go func() {
+				client.Write([]byte(tt.input))
+				client.Close()
+			}()
+			h.ModifyAndForward(proxyDst, proxySrc, "192.0.2.1:80", "192.0.2.1", 80, tracker)
+			proxyDst.Close()
+			if len(tracker.pending) != tt.pending || tracker.stopped != tt.stopped {
+				t.Errorf("pending %d stopped %v, want %d %v", len(tracker.pending), tracker.stopped, tt.pending, tt.stopped)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Host 映射文件 (-host-map) 格式：每行 "<域名> <替换 UA|pass>"，按 Host 选择替换 UA
+//
+//	*.bilibili.com "Mozilla/5.0 (Windows NT 10.0; Win64; x64) ... Chrome/120.0.0.0 Safari/537.36"
+//	*.apple.com    pass
+//
+// "example.com" 匹配自身及子域名，"*.example.com" 仅匹配子域名；多项命中时最长的域名生效
+// 未命中的 Host 使用 -u；pass 表示不修改该域名的 UA
+
+const hostMapPass = "pass"
+
+var hostPatternLabel = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// hostEntry 是 Host 映射表中的一项
+type hostEntry struct {
+	class string // 命中的域名规则，作为缓存键的一部分
+	ua    string // 替换 UA
+	pass  bool   // 不修改 UA
+}
+
+// domainTrie 是按域名标签倒序 (com -> bilibili -> www) 组织的后缀树
+type domainTrie struct {
+	children map[string]*domainTrie
+	self     *hostEntry // "example.com"：自身及子域名
+	sub      *hostEntry // "*.example.com"：仅子域名
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+// Insert 添加一条域名规则，重复的规则返回 false
+func (t *domainTrie) Insert(pattern string, entry *hostEntry) bool {
+	wildcard := strings.HasPrefix(pattern, "*.")
+	labels := strings.Split(strings.TrimPrefix(pattern, "*."), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	slot := &node.self
+	if wildcard {
+		slot = &node.sub
+	}
+	if *slot != nil {
+		return false
+	}
+	*slot = entry
+	return true
+}
+
+// Lookup 返回与 host 匹配的最长域名规则，没有命中时返回 nil
+func (t *domainTrie) Lookup(host string) *hostEntry {
+	if t == nil || host == "" {
+		return nil
+	}
+	var found *hostEntry
+	node := t
+	rest := host
+	for rest != "" {
+		var label string
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			label, rest = rest, ""
+		}
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		node = child
+		if node.self != nil {
+			found = node.self
+		}
+		if rest != "" && node.sub != nil {
+			found = node.sub
+		}
+	}
+	return found
+}
+
+// LoadHostMap 读取 Host 映射文件
+func LoadHostMap(path string) (*domainTrie, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open host map: %w", err)
+	}
+	defer file.Close()
+
+	trie := newDomainTrie()
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		tokens, err := uciTokens(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("host map %s line %d: %w", path, lineNo, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		if len(tokens) != 2 || tokens[1] == "" {
+			return nil, fmt.Errorf("host map %s line %d: expected \"<domain> <user-agent|pass>\"", path, lineNo)
+		}
+		pattern := strings.ToLower(strings.TrimSuffix(tokens[0], "."))
+		if !validHostPattern(pattern) {
+			return nil, fmt.Errorf("host map %s line %d: invalid domain %q", path, lineNo, tokens[0])
+		}
+		entry := &hostEntry{class: pattern, ua: tokens[1], pass: tokens[1] == hostMapPass}
+		if !trie.Insert(pattern, entry) {
+			return nil, fmt.Errorf("host map %s line %d: duplicate domain %q", path, lineNo, pattern)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return trie, nil
+}
+
+// validHostPattern 校验 "example.com" 或 "*.example.com" 形式的域名
+func validHostPattern(pattern string) bool {
+	for _, label := range strings.Split(strings.TrimPrefix(pattern, "*."), ".") {
+		if !hostPatternLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
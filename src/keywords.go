@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keywordMatcher 将关键词列表编译为 Aho-Corasick 自动机，一次扫描即可找出命中的关键词
+// ignoreCase 仅折叠 ASCII 字母；wholeWord 要求关键词两端 (为字母数字时) 不与其他字母数字相连
+type keywordMatcher struct {
+	keywords   []string
+	nodes      []acNode
+	ignoreCase bool
+	wholeWord  bool
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  []int32 // 在此结束的关键词 (含 fail 链上的)
+}
+
+// newKeywordMatcher 编译关键词列表，空列表返回 nil
+func newKeywordMatcher(keywords []string, ignoreCase, wholeWord bool) *keywordMatcher {
+	if len(keywords) == 0 {
+		return nil
+	}
+	m := &keywordMatcher{
+		keywords:   keywords,
+		nodes:      []acNode{{next: map[byte]int32{}}},
+		ignoreCase: ignoreCase,
+		wholeWord:  wholeWord,
+	}
+
+	// 1. 构建 trie
+	for i, kw := range keywords {
+		s := int32(0)
+		for j := 0; j < len(kw); j++ {
+			c := m.fold(kw[j])
+			n, ok := m.nodes[s].next[c]
+			if !ok {
+				n = int32(len(m.nodes))
+				m.nodes = append(m.nodes, acNode{next: map[byte]int32{}})
+				m.nodes[s].next[c] = n
+			}
+			s = n
+		}
+		m.nodes[s].out = append(m.nodes[s].out, int32(i))
+	}
+
+	// 2. 广度优先计算 fail 指针并合并输出
+	queue := make([]int32, 0, len(m.nodes))
+	for _, n := range m.nodes[0].next {
+		queue = append(queue, n)
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for c, n := range m.nodes[s].next {
+			f := m.nodes[s].fail
+			for f > 0 {
+				if _, ok := m.nodes[f].next[c]; ok {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if t, ok := m.nodes[f].next[c]; ok && t != n {
+				m.nodes[n].fail = t
+			}
+			m.nodes[n].out = append(m.nodes[n].out, m.nodes[m.nodes[n].fail].out...)
+			queue = append(queue, n)
+		}
+	}
+	return m
+}
+
+func (m *keywordMatcher) fold(c byte) byte {
+	if m.ignoreCase && c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// Match 返回 s 中第一个命中的关键词 (在 s 中最早结束的)
+func (m *keywordMatcher) Match(s string) (string, bool) {
+	idx := m.match(s, false)
+	if idx < 0 {
+		return "", false
+	}
+	return m.keywords[idx], true
+}
+
+// MatchByOrder 返回命中的关键词中在列表里最靠前的，用于关键词专属的替换 UA
+// 需要扫描整个 s，只在结果依赖列表顺序时使用
+func (m *keywordMatcher) MatchByOrder(s string) (string, bool) {
+	idx := m.match(s, true)
+	if idx < 0 {
+		return "", false
+	}
+	return m.keywords[idx], true
+}
+
+// match 返回命中的关键词下标，未命中时返回 -1
+// byOrder 为 false 时返回第一个命中的，为 true 时返回下标最小的
+func (m *keywordMatcher) match(s string, byOrder bool) int32 {
+	if m == nil {
+		return -1
+	}
+	best := int32(-1)
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		c := m.fold(s[i])
+		for {
+			if n, ok := m.nodes[state].next[c]; ok {
+				state = n
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = m.nodes[state].fail
+		}
+		for _, idx := range m.nodes[state].out {
+			if best >= 0 && idx >= best {
+				continue
+			}
+			kw := m.keywords[idx]
+			if m.wholeWord && !isWholeWord(s, i+1-len(kw), i+1) {
+				continue
+			}
+			if !byOrder || idx == 0 {
+				return idx
+			}
+			best = idx
+		}
+	}
+	return best
+}
+
+// Len 返回关键词数量
+func (m *keywordMatcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.keywords)
+}
+
+// isWholeWord 判断 s[start:end] 两端是否处于单词边界
+func isWholeWord(s string, start, end int) bool {
+	if start > 0 && isWordByte(s[start]) && isWordByte(s[start-1]) {
+		return false
+	}
+	if end < len(s) && isWordByte(s[end-1]) && isWordByte(s[end]) {
+		return false
+	}
+	return true
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// splitKeywordReplacements 拆分 "关键词=替换 UA" 形式的条目，返回关键词列表与各关键词的替换 UA
+// 不带 = 的条目使用 -u；同一关键词不能对应不同的替换 UA
+func splitKeywordReplacements(entries []string) ([]string, map[string]string, error) {
+	keywords := make([]string, 0, len(entries))
+	replacements := make(map[string]string)
+	for _, entry := range entries {
+		kw, ua, ok := strings.Cut(entry, "=")
+		kw = strings.TrimSpace(kw)
+		if kw == "" {
+			return nil, nil, fmt.Errorf("empty keyword in %q", entry)
+		}
+		if ok {
+			ua = strings.TrimSpace(ua)
+			if ua == "" {
+				return nil, nil, fmt.Errorf("empty replacement for keyword %q", kw)
+			}
+			if old, dup := replacements[kw]; dup && old != ua {
+				return nil, nil, fmt.Errorf("conflicting replacements for keyword %q", kw)
+			}
+			replacements[kw] = ua
+		}
+		keywords = append(keywords, kw)
+	}
+	return keywords, replacements, nil
+}
+
+// readKeywordsFile 读取关键词文件，每行一个 (可写作 关键词=替换 UA)，忽略空行与 # 注释行
+func readKeywordsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keywords file: %w", err)
+	}
+	defer file.Close()
+	var keywords []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keywords = append(keywords, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read keywords file: %w", err)
+	}
+	return keywords, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeywordMatcher(t *testing.T) {
+	tests := []struct {
+		name       string
+		keywords   []string
+		ignoreCase bool
+		wholeWord  bool
+		s          string
+		first      string // Match 的结果，未命中为空
+		byOrder    string // MatchByOrder 的结果
+	}{
+		{"no match", []string{"iPhone", "Android"}, false, false, "Windows NT", "", ""},
+		{"overlap suffix prefers longer", []string{"droid", "Android"}, false, false, "Linux; Android 14", "Android", "droid"},
+		{"overlap ends earlier", []string{"Android 14", "Android"}, false, false, "Linux; Android 14", "Android", "Android 14"},
+		{"overlap prefix", []string{"Phone", "iPhone"}, false, false, "(iPhone; CPU", "iPhone", "Phone"},
+		{"list order wins over position", []string{"Mobile", "Linux"}, false, false, "Linux; Android; Mobile", "Linux", "Mobile"},
+		{"nested via fail link", []string{"abcd", "bc"}, false, false, "xabcdx", "bc", "abcd"},
+		{"duplicate keyword", []string{"x", "x"}, false, false, "axb", "x", "x"},
+		{"case sensitive", []string{"android"}, false, false, "Android", "", ""},
+		{"ignore case", []string{"ANDROID"}, true, false, "linux; android", "ANDROID", "ANDROID"},
+		{"ignore case only folds ascii", []string{"É"}, true, false, "é", "", ""},
+		{"whole word rejects substring", []string{"Phone"}, false, true, "iPhone", "", ""},
+		{"whole word at later position", []string{"Phone"}, false, true, "iPhone Phone", "Phone", "Phone"},
+		{"whole word overlap", []string{"Android", "droid"}, false, true, "Android 14", "Android", "Android"},
+		{"whole word punctuation keyword", []string{"(iPhone;"}, false, true, "Mozilla/5.0 (iPhone; CPU", "(iPhone;", "(iPhone;"},
+		{"whole word underscore", []string{"bot"}, false, true, "my_bot/1.0", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newKeywordMatcher(tt.keywords, tt.ignoreCase, tt.wholeWord)
+			if got, _ := m.Match(tt.s); got != tt.first {
+				t.Errorf("Match = %q, want %q", got, tt.first)
+			}
+			if got, _ := m.MatchByOrder(tt.s); got != tt.byOrder {
+				t.Errorf("MatchByOrder = %q, want %q", got, tt.byOrder)
+			}
+		})
+	}
+}
+
+func TestKeywordMatcherEmpty(t *testing.T) {
+	m := newKeywordMatcher(nil, true, true)
+	if m != nil {
+		t.Fatal("empty list should compile to nil")
+	}
+	if _, ok := m.Match("anything"); ok {
+		t.Error("nil matcher matched")
+	}
+	if _, ok := m.MatchByOrder("anything"); ok {
+		t.Error("nil matcher matched")
+	}
+	if m.Len() != 0 {
+		t.Errorf("Len = %d", m.Len())
+	}
+}
+
+// TestKeywordMatcherAgainstNaive 与逐个关键词 strings.Index 的结果对比
+func TestKeywordMatcherAgainstNaive(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	word := func(n int) string {
+		b := make([]byte, 1+rnd.Intn(n))
+		for i := range b {
+			b[i] = "abAB _"[rnd.Intn(6)]
+		}
+		return string(b)
+	}
+	for iter := 0; iter < 2000; iter++ {
+		keywords := make([]string, 1+rnd.Intn(5))
+		for i := range keywords {
+			keywords[i] = word(4)
+		}
+		s := word(24)
+		wholeWord := rnd.Intn(2) == 0
+		m := newKeywordMatcher(keywords, false, wholeWord)
+
+		// 朴素实现：byOrder 取列表中第一个出现的；否则取结束位置最早的
+		naiveOrder, naiveFirst, firstEnd := "", "", len(s)+1
+		for _, kw := range keywords {
+			for start := 0; start+len(kw) <= len(s); start++ {
+				if s[start:start+len(kw)] != kw || wholeWord && !isWholeWord(s, start, start+len(kw)) {
+					continue
+				}
+				if naiveOrder == "" {
+					naiveOrder = kw
+				}
+				if end := start + len(kw); end < firstEnd {
+					naiveFirst, firstEnd = kw, end
+				}
+				break
+			}
+		}
+		if got, _ := m.MatchByOrder(s); got != naiveOrder {
+			t.Fatalf("MatchByOrder(%q) with %q whole=%v = %q, want %q", s, keywords, wholeWord, got, naiveOrder)
+		}
+		// Match 在同一结束位置上可能返回任意一个，只比较结束位置
+		got, ok := m.Match(s)
+		if ok != (naiveFirst != "") {
+			t.Fatalf("Match(%q) with %q whole=%v = %q, want %q", s, keywords, wholeWord, got, naiveFirst)
+		}
+		if ok && !endsAt(s, got, firstEnd, wholeWord) {
+			t.Fatalf("Match(%q) with %q whole=%v = %q, want a match ending at %d", s, keywords, wholeWord, got, firstEnd)
+		}
+	}
+}
+
+func endsAt(s, kw string, end int, wholeWord bool) bool {
+	start := end - len(kw)
+	return start >= 0 && s[start:end] == kw && (!wholeWord || isWholeWord(s, start, end))
+}
+
+func TestSplitKeywordReplacements(t *testing.T) {
+	keywords, replacements, err := splitKeywordReplacements([]string{"iPhone", " Android = Masked-Android ", "iPhone=Masked-iPhone", "iPhone=Masked-iPhone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"iPhone", "Android", "iPhone", "iPhone"}; !reflect.DeepEqual(keywords, want) {
+		t.Errorf("keywords = %q, want %q", keywords, want)
+	}
+	if want := map[string]string{"Android": "Masked-Android", "iPhone": "Masked-iPhone"}; !reflect.DeepEqual(replacements, want) {
+		t.Errorf("replacements = %v, want %v", replacements, want)
+	}
+
+	for _, entries := range [][]string{{" =UA"}, {"iPhone="}, {"iPhone=A", "iPhone=B"}} {
+		if _, _, err := splitKeywordReplacements(entries); err == nil {
+			t.Errorf("%q: expected error", entries)
+		}
+	}
+}
+
+func TestReadKeywordsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keywords")
+	if err := os.WriteFile(path, []byte("# 注释\niPhone\n\n  Android=Masked UA  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readKeywordsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"iPhone", "Android=Masked UA"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := readKeywordsFile(path + ".missing"); err == nil || !strings.Contains(err.Error(), "failed to open") {
+		t.Errorf("missing file: error %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// 自动学习白名单 (-learn-whitelist)：
+// 在服务器 -> 客户端方向按顺序将响应与请求配对，某个 Host 连续 -learn-threshold 次以 403/406
+// 拒绝修改过 UA 的请求、而未修改的请求没有被拒绝时，该 Host 在 -learn-ttl 内不再修改 UA。
+// 学习结果可以通过统计文件与控制接口 (/learned) 查看和撤销。
+// 响应配对同时用于判断 Upgrade / CONNECT 隧道是否建立 (101 或 CONNECT 的 2xx)；
+// 未开启学习时只配对连接开头的隧道请求，之后的请求使响应方向停止解析、原样转发。
+
+var errUnknownFraming = errors.New("response body length unknown")
+
+// isRejectStatus 判断响应是否可能是因 UA 被拒绝
+func isRejectStatus(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusNotAcceptable
+}
+
+// hostResponseStats 记录某个 Host 最近的响应情况
+type hostResponseStats struct {
+	modifiedRejects   int // 修改 UA 后连续被拒绝的次数
+	unmodifiedRejects int // 未修改 UA 时连续被拒绝的次数
+}
+
+// learnedWhitelist 是自动学习的临时白名单
+type learnedWhitelist struct {
+	mu      sync.Mutex
+	hosts   *lru.Cache[string, *hostResponseStats]
+	entries map[string]time.Time // Host -> 过期时间
+}
+
+func newLearnedWhitelist() *learnedWhitelist {
+	hosts, _ := lru.New[string, *hostResponseStats](4096)
+	return &learnedWhitelist{hosts: hosts, entries: make(map[string]time.Time)}
+}
+
+// Contains 判断 host 是否在学习到的白名单中
+func (l *learnedWhitelist) Contains(host string) bool {
+	if host == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires, ok := l.entries[host]
+	if ok && time.Now().After(expires) {
+		delete(l.entries, host)
+		return false
+	}
+	return ok
+}
+
+// Record 记录一次响应，host 因此被加入白名单时返回 true
+func (l *learnedWhitelist) Record(host string, modified bool, status int, threshold int, ttl time.Duration) bool {
+	if status < 200 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[host]; ok {
+		return false
+	}
+	s, ok := l.hosts.Get(host)
+	if !ok {
+		if !isRejectStatus(status) {
+			return false
+		}
+		s = &hostResponseStats{}
+		l.hosts.Add(host, s)
+	}
+	rejected := isRejectStatus(status)
+	switch {
+	case !modified && rejected:
+		s.unmodifiedRejects++
+	case !modified && status < 400:
+		s.unmodifiedRejects = 0
+	case modified && rejected:
+		s.modifiedRejects++
+	case modified && status < 400:
+		s.modifiedRejects = 0
+	}
+	if s.modifiedRejects < threshold || s.unmodifiedRejects > 0 {
+		return false
+	}
+	l.hosts.Remove(host)
+	l.entries[host] = time.Now().Add(ttl)
+	return true
+}
+
+// learnedEntry 是白名单中的一项
+type learnedEntry struct {
+	Host    string
+	Expires time.Time
+}
+
+// Entries 返回未过期的条目，按 Host 排序
+func (l *learnedWhitelist) Entries() []learnedEntry {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	l.mu.Lock()
+	entries := make([]learnedEntry, 0, len(l.entries))
+	for host, expires := range l.entries {
+		if now.After(expires) {
+			delete(l.entries, host)
+			continue
+		}
+		entries = append(entries, learnedEntry{Host: host, Expires: expires})
+	}
+	l.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Host < entries[j].Host })
+	return entries
+}
+
+// Revoke 移除 host，host 为空时清空白名单，返回移除的条目数
+func (l *learnedWhitelist) Revoke(host string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if host == "" {
+		n := len(l.entries)
+		l.entries = make(map[string]time.Time)
+		l.hosts.Purge()
+		return n
+	}
+	host = requestHost(host)
+	if _, ok := l.entries[host]; !ok {
+		return 0
+	}
+	delete(l.entries, host)
+	return 1
+}
+
+// pendingRequest 是已转发、尚未收到响应的请求
+type pendingRequest struct {
+	host     string
+	method   string
+	modified bool
+	tunnel   bool // Upgrade 或 CONNECT 请求
+}
+
+// tunnelState 是最近一个 Upgrade / CONNECT 请求的结果
+type tunnelState int
+
+const (
+	tunnelUnknown tunnelState = iota // 没有隧道请求，或在响应到达前停止了配对
+	tunnelWaiting                    // 等待响应
+	tunnelOpen                       // 服务器返回 101，或对 CONNECT 返回 2xx
+	tunnelRefused                    // 服务器拒绝，连接继续按 HTTP 处理
+)
+
+// responseTracker 按顺序记录同一连接上转发的请求，供响应方向配对
+// 请求方向无法继续逐个解析请求 (回退、隧道、非 HTTP) 时调用 Stop，响应方向随即改为原样转发
+type responseTracker struct {
+	mu      sync.Mutex
+	pending []pendingRequest
+	stopped bool
+
+	tunnel     tunnelState
+	tunnelDone chan struct{} // 隧道结果确定或停止配对时关闭
+}
+
+// Push 记录一个请求，必须在请求写往服务器之前调用
+func (t *responseTracker) Push(req pendingRequest) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if !t.stopped {
+		t.pending = append(t.pending, req)
+		if req.tunnel {
+			t.tunnel = tunnelWaiting
+			t.tunnelDone = make(chan struct{})
+		}
+	}
+	t.mu.Unlock()
+}
+
+// Stop 停止配对
+func (t *responseTracker) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stopped = true
+	t.pending = nil
+	t.settleTunnel(tunnelUnknown)
+	t.mu.Unlock()
+}
+
+// settleTunnel 记录隧道结果，调用方需持有 mu
+func (t *responseTracker) settleTunnel(state tunnelState) {
+	if t.tunnel != tunnelWaiting {
+		return
+	}
+	t.tunnel = state
+	close(t.tunnelDone)
+}
+
+// TunnelResult 等待最近一个 Upgrade / CONNECT 请求的响应，最多等待 wait，超时返回 tunnelUnknown
+func (t *responseTracker) TunnelResult(wait time.Duration) tunnelState {
+	if t == nil {
+		return tunnelUnknown
+	}
+	t.mu.Lock()
+	state, done := t.tunnel, t.tunnelDone
+	t.mu.Unlock()
+	if state != tunnelWaiting {
+		return state
+	}
+	select {
+	case <-done:
+	case <-time.After(wait):
+		return tunnelUnknown
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tunnel
+}
+
+// front 返回最早的待配对请求
+func (t *responseTracker) front() (pendingRequest, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || len(t.pending) == 0 {
+		return pendingRequest{}, false
+	}
+	return t.pending[0], true
+}
+
+// pop 移除最早的待配对请求；该请求是隧道请求时根据最终响应的状态码记录隧道结果
+func (t *responseTracker) pop(status int) {
+	t.mu.Lock()
+	if len(t.pending) > 0 {
+		if req := t.pending[0]; req.tunnel {
+			if tunnelEstablished(req.method, status) {
+				t.settleTunnel(tunnelOpen)
+			} else {
+				t.settleTunnel(tunnelRefused)
+			}
+		}
+		t.pending = t.pending[1:]
+	}
+	t.mu.Unlock()
+}
+
+// tunnelEstablished 判断最终响应是否表示隧道已建立
+func tunnelEstablished(method string, status int) bool {
+	return status == http.StatusSwitchingProtocols || (method == http.MethodConnect && status >= 200 && status < 300)
+}
+
+// RelayResponses 转发服务器 -> 客户端的数据；tracker 不为 nil 时逐个解析响应头并与请求配对
+// 响应字节原样转发，无法确定边界时改为 Relay
+func (h *HTTPHandler) RelayResponses(dst net.Conn, src net.Conn, tracker *responseTracker) {
+	if tracker == nil {
+		h.Relay(dst, src, nil)
+		return
+	}
+	reader := h.bufioReaderPool.Get().(*bufio.Reader)
+	reader.Reset(src)
+	defer h.bufioReaderPool.Put(reader)
+	defer tracker.Stop()
+
+	for {
+		// 等到响应到达再检查是否有待配对的请求，避免服务器先发数据的协议被阻塞
+		if _, err := reader.Peek(1); err != nil {
+			break
+		}
+		req, ok := tracker.front()
+		if !ok {
+			break
+		}
+		if prefix, err := reader.Peek(5); err != nil || string(prefix) != "HTTP/" {
+			break
+		}
+		block, err := peekUntilFunc(reader, headerBlockEnd)
+		if err != nil {
+			break
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+		if err != nil {
+			break
+		}
+		status := resp.StatusCode
+		final := status >= 200 || status == http.StatusSwitchingProtocols
+		if final {
+			// 在响应发给客户端之前记录隧道结果，客户端收到响应后才会发送隧道数据
+			tracker.pop(status)
+		}
+		if _, err := dst.Write(block); err != nil {
+			return
+		}
+		reader.Discard(len(block))
+		if !final {
+			// 100 Continue 等中间响应之后还有最终响应
+			continue
+		}
+		h.learnFromResponse(req, status)
+		if tunnelEstablished(req.method, status) {
+			break
+		}
+		if err := copyResponseBody(dst, reader, src, req.method, resp); err != nil {
+			if err == errUnknownFraming {
+				break
+			}
+			logrus.Debugf("[Learn] Response relay error: %v", err)
+			return
+		}
+	}
+	tracker.Stop()
+	if _, err := h.Relay(dst, src, reader); err != nil && err != io.EOF {
+		logrus.Debugf("[Learn] Fallback copy error: %v", err)
+	}
+}
+
+// learnFromResponse 根据响应状态更新学习白名单
+func (h *HTTPHandler) learnFromResponse(req pendingRequest, status int) {
+	config := h.config.Load()
+	if !config.LearnWhitelist || req.host == "" {
+		return
+	}
+	if h.learned.Record(req.host, req.modified, status, config.LearnThreshold, config.LearnTTL) {
+		logrus.Infof("[Learn] %s rejected modified User-Agent %d times (status %d), whitelisted for %s", req.host, config.LearnThreshold, status, config.LearnTTL)
+	}
+}
+
+// copyResponseBody 原样转发响应 body，body 以连接关闭结束时返回 errUnknownFraming
+// src 是 reader 的底层连接，定长 body 中未缓冲的部分直接从 src 转发
+func copyResponseBody(dst io.Writer, reader *bufio.Reader, src io.Reader, method string, resp *http.Response) error {
+	status := resp.StatusCode
+	if method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+		return nil
+	}
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return copyChunkedBody(dst, reader)
+		}
+	}
+	if resp.ContentLength < 0 {
+		return errUnknownFraming
+	}
+	return copyFixedBody(dst, reader, src, resp.ContentLength)
+}
+
+// copyFixedBody 转发 n 字节：先转发 reader 中已缓冲的部分，其余绕过 reader 直接读取 src，
+// 两端都是 TCP 连接时可以使用 splice
+func copyFixedBody(dst io.Writer, reader *bufio.Reader, src io.Reader, n int64) error {
+	if buffered := min(int64(reader.Buffered()), n); buffered > 0 {
+		if err := copyDiscard(dst, reader, int(buffered)); err != nil {
+			return err
+		}
+		n -= buffered
+	}
+	if n == 0 {
+		return nil
+	}
+	written, err := io.Copy(dst, io.LimitReader(src, n))
+	if err == nil && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyChunkedBody 原样转发 chunked 编码的 body (含结尾的 trailer)
+func copyChunkedBody(dst io.Writer, reader *bufio.Reader) error {
+	for {
+		line, err := copyLine(dst, reader)
+		if err != nil {
+			return err
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			// 无法解析的 chunk，剩余数据交给 Relay 原样转发
+			return errUnknownFraming
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(dst, reader, size); err != nil {
+			return err
+		}
+		// chunk 数据后的 CRLF
+		if _, err := copyLine(dst, reader); err != nil {
+			return err
+		}
+	}
+	// trailer，以空行结束
+	for {
+		line, err := copyLine(dst, reader)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil
+		}
+	}
+}
+
+// copyLine 转发一行并返回其内容，行超过缓冲区大小时返回 errUnknownFraming
+func copyLine(dst io.Writer, reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if len(line) > 0 {
+		if _, werr := dst.Write(line); werr != nil {
+			return nil, werr
+		}
+	}
+	if err == bufio.ErrBufferFull {
+		return nil, errUnknownFraming
+	}
+	return line, err
+}
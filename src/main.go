@@ -1,7 +1,13 @@
 package main
 
 import (
+	"flag"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -42,7 +48,15 @@ func setupLogging(logLevel, logFile string) {
 }
 
 func main() {
-	config, err := NewConfig()
+	// 防火墙规则子命令，供 init 脚本调用
+	if len(os.Args) > 1 && os.Args[1] == "fw" {
+		os.Exit(runFirewallCommand(os.Args[2:]))
+	}
+
+	config, err := NewConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
 		logrus.Fatalf("Failed to load config: %v", err)
 		os.Exit(1)
@@ -56,24 +70,121 @@ func main() {
 	}
 
 	config.LogConfig(version)
+	if config.GCPercent > 0 {
+		debug.SetGCPercent(config.GCPercent)
+	}
 
 	stats := NewStats()
 	stats.StartWriter("/tmp/UAmask.stats", 5*time.Second)
 
-	uaCache, err := lru.New[string, string](config.CacheSize)
+	uaCache, err := lru.New[string, uaCacheEntry](config.CacheSize)
 	if err != nil {
 		logrus.Fatalf("Failed to create LRU cache: %v", err)
 	}
 
 	fwManager := NewFirewallSetManager(logrus.StandardLogger(), 10000, config)
 	fwManager.Start()
-	defer fwManager.Stop()
+	stats.SetFirewallSource(fwManager)
 	handler := NewHTTPHandler(config, stats, uaCache, fwManager)
 
 	server := NewServer(config, handler)
+	reloader := NewReloader(handler, fwManager)
+
+	var controlListener net.Listener
+	if config.ControlSocket != "" {
+		controlListener, err = StartControlServer(config.ControlSocket, stats, reloader, handler.learned)
+		if err != nil {
+			logrus.Warnf("Control API disabled: %v", err)
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2, signalRetire)
+
+	// Run() 会阻塞，直到监听失败或被 Shutdown 关闭
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Run()
+	}()
 
-	// Run() 会阻塞，直到发生致命错误
-	if err := server.Run(); err != nil {
-		logrus.Fatalf("Server failed to run: %v", err)
+	// handOver 在新进程接管后排空已有连接
+	// 统计文件与控制接口由新进程接管，关闭时不能删除新进程创建的 socket 文件
+	handOver := func() {
+		stats.StopWriter()
+		if ul, ok := controlListener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		server.Shutdown(handler.config.Load().DrainTimeout)
+	}
+
+	exitCode := 0
+	var upgraded *exec.Cmd
+	var upgradeFiles []*os.File // 交给新进程的监听器 fd，监督进程之后的升级继续使用
+loop:
+	for {
+		select {
+		case sig := <-sigChan:
+			switch sig {
+			case syscall.SIGHUP:
+				logrus.Info("Received SIGHUP, reloading configuration...")
+				reloader.Reload()
+				continue
+			case syscall.SIGUSR2:
+				if isSupervised() {
+					// 由监督进程启动新进程并让本进程退出，避免每次升级多一个常驻进程
+					logrus.Info("Received SIGUSR2, passing the upgrade to the supervisor...")
+					syscall.Kill(os.Getppid(), syscall.SIGUSR2)
+					continue
+				}
+				logrus.Info("Received SIGUSR2, handing listeners over to a new process...")
+				files, err := listenerFiles(server.Listeners())
+				if err == nil {
+					upgraded, err = spawnUpgrade(files)
+					if err != nil {
+						closeFiles(files)
+					}
+				}
+				if err != nil {
+					logrus.Errorf("[Upgrade] Upgrade aborted, keep serving: %v", err)
+					continue
+				}
+				logrus.Infof("[Upgrade] Process %d is accepting connections, draining old connections", upgraded.Process.Pid)
+				upgradeFiles = files
+				handOver()
+				break loop
+			case signalRetire:
+				if !isSupervised() {
+					continue
+				}
+				logrus.Info("[Upgrade] Replaced by a new process, draining old connections...")
+				handOver()
+				break loop
+			}
+			logrus.Infof("Received signal %s, shutting down...", sig)
+			server.Shutdown(handler.config.Load().DrainTimeout)
+			break loop
+		case err := <-errChan:
+			logrus.Errorf("Server failed to run: %v", err)
+			exitCode = 1
+			break loop
+		}
+	}
+
+	// 写入剩余的防火墙批次与最终统计后退出
+	fwManager.Stop()
+	if controlListener != nil {
+		controlListener.Close()
+	}
+	if err := stats.WriteSnapshot(); err != nil {
+		logrus.Warnf("Failed to write final stats: %v", err)
+	}
+	if upgraded != nil {
+		logrus.Infof("[Upgrade] Old connections drained, supervising process %d", upgraded.Process.Pid)
+		exitCode = superviseChild(upgraded, upgradeFiles, sigChan)
+		closeFiles(upgradeFiles)
+	}
+	logrus.Info("UA-Mask stopped")
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
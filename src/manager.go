@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -36,6 +37,7 @@ type reportEvent struct {
 type FirewallSetManager struct {
 	queue    chan firewallAddItem
 	stopChan chan struct{}
+	stopOnce sync.Once
 	wg       sync.WaitGroup
 	log      *logrus.Logger
 
@@ -45,23 +47,55 @@ type FirewallSetManager struct {
 	portProfiles     map[string]*portProfile
 	profileLock      sync.Mutex
 
-	// 画像配置
-	nonHttpThreshold       int           // 判定为非HTTP的连接数阈值
-	httpCooldownPeriod     time.Duration // HTTP事件后的豁免期
-	decisionDelay          time.Duration // 满足条件后的决策延迟
+	// 可重载的配置
+	settings atomic.Pointer[managerSettings]
+
 	profileCleanupInterval time.Duration // 清理陈旧画像的周期
 
+	maxBatchSize int
+	maxBatchWait time.Duration
+
+	// 空跑 (审计模式)：仅由 worker 访问的已"卸载"条目及其过期时间，以及累计卸载数
+	dryRunSet      map[string]time.Time
+	dryRunOffloads atomic.Uint64
+}
+
+// managerSettings 是可在运行时整体替换的决策与防火墙配置
+type managerSettings struct {
+	// 画像配置
+	nonHttpThreshold   int           // 判定为非HTTP的连接数阈值
+	httpCooldownPeriod time.Duration // HTTP事件后的豁免期
+	decisionDelay      time.Duration // 满足条件后的决策延迟
+
 	// 防火墙配置
 	firewallIPSetName string
 	firewallType      string
 	defaultTimeout    int
+	sniAllow          []string // 命中即立即卸载
+	sniDeny           []string // 永不卸载
+	protocolPolicies  map[Protocol]string
+	dryRun            bool // 只记录本应执行的卸载，不调用 nft/ipset
+}
 
-	maxBatchSize int
-	maxBatchWait time.Duration
+func newManagerSettings(cfg *Config) *managerSettings {
+	return &managerSettings{
+		nonHttpThreshold:   cfg.FirewallNonHttpThreshold,
+		httpCooldownPeriod: cfg.FirewallHttpCooldownPeriod,
+		decisionDelay:      cfg.FirewallDecisionDelay,
+
+		// 从配置中获取防火墙信息
+		firewallIPSetName: cfg.FirewallIPSetName,
+		firewallType:      cfg.FirewallType,
+		defaultTimeout:    cfg.FirewallTimeout,
+		sniAllow:          cfg.FirewallSNIAllow,
+		sniDeny:           cfg.FirewallSNIDeny,
+		protocolPolicies:  cfg.ProtocolPolicies,
+		dryRun:            cfg.Audit,
+	}
 }
 
 func NewFirewallSetManager(log *logrus.Logger, queueSize int, cfg *Config) *FirewallSetManager {
-	return &FirewallSetManager{
+	m := &FirewallSetManager{
 		queue:    make(chan firewallAddItem, queueSize),
 		stopChan: make(chan struct{}),
 		log:      log,
@@ -72,19 +106,21 @@ func NewFirewallSetManager(log *logrus.Logger, queueSize int, cfg *Config) *Fire
 		portProfiles:     make(map[string]*portProfile),
 
 		// default config
-		nonHttpThreshold:       cfg.FirewallNonHttpThreshold,
-		httpCooldownPeriod:     cfg.FirewallHttpCooldownPeriod,
-		decisionDelay:          cfg.FirewallDecisionDelay,
 		profileCleanupInterval: 10 * time.Minute,
 
-		// 从配置中获取防火墙信息
-		firewallIPSetName: cfg.FirewallIPSetName,
-		firewallType:      cfg.FirewallType,
-		defaultTimeout:    cfg.FirewallTimeout,
-
 		maxBatchSize: 200,
 		maxBatchWait: 100 * time.Millisecond,
+
+		dryRunSet: make(map[string]time.Time),
 	}
+	m.settings.Store(newManagerSettings(cfg))
+	return m
+}
+
+// ApplyConfig 替换决策与防火墙配置，已有的端口画像保留
+func (m *FirewallSetManager) ApplyConfig(cfg *Config) {
+	m.settings.Store(newManagerSettings(cfg))
+	m.log.Info("[Manager] Configuration applied")
 }
 
 // ReportHttpEvent 一票否决
@@ -105,6 +141,39 @@ func (m *FirewallSetManager) ReportNonHttpEvent(ip string, port int) {
 	}
 }
 
+// ReportTlsEvent 根据 SNI 名单决定立即卸载、保留或按非 HTTP 计分
+func (m *FirewallSetManager) ReportTlsEvent(ip string, port int, serverName string) {
+	settings := m.settings.Load()
+	for _, domain := range settings.sniDeny {
+		if matchDomainSuffix(serverName, domain) {
+			m.log.Debugf("[Manager] TLS %s:%d (SNI %s) hit SNI deny list, never offload.", ip, port, serverName)
+			return
+		}
+	}
+	for _, domain := range settings.sniAllow {
+		if matchDomainSuffix(serverName, domain) {
+			m.log.Debugf("[Manager] TLS %s:%d (SNI %s) hit SNI allow list, offloading.", ip, port, serverName)
+			m.Add(ip, port, settings.firewallIPSetName, settings.firewallType, settings.defaultTimeout)
+			return
+		}
+	}
+	m.ReportProtocolEvent(ip, port, ProtoTLS)
+}
+
+// ReportProtocolEvent 按协议策略处理非 HTTP 连接
+func (m *FirewallSetManager) ReportProtocolEvent(ip string, port int, proto Protocol) {
+	settings := m.settings.Load()
+	switch settings.protocolPolicies[proto] {
+	case PolicyOffload:
+		m.log.Debugf("[Manager] %s traffic to %s:%d, policy offload.", proto, ip, port)
+		m.Add(ip, port, settings.firewallIPSetName, settings.firewallType, settings.defaultTimeout)
+	case PolicyNever:
+		m.log.Debugf("[Manager] %s traffic to %s:%d, policy never offload.", proto, ip, port)
+	default:
+		m.ReportNonHttpEvent(ip, port)
+	}
+}
+
 func (m *FirewallSetManager) Add(ip string, port int, setName, fwType string, timeout int) {
 	if ip == "" || setName == "" {
 		return
@@ -144,7 +213,7 @@ func (m *FirewallSetManager) Start() {
 // Stop worker
 func (m *FirewallSetManager) Stop() {
 	m.log.Info("[Manager] Stopping FirewallSetManager worker...")
-	close(m.stopChan)
+	m.stopOnce.Do(func() { close(m.stopChan) })
 	m.wg.Wait() // 等待 worker 完成
 	m.log.Info("[Manager] FirewallSetManager worker stopped")
 }
@@ -170,10 +239,7 @@ func (m *FirewallSetManager) worker() {
 	for {
 		select {
 		case <-m.stopChan:
-			// 收到停止信号
-			close(m.queue)
-			m.executeBatches(batches)
-			// 清理所有画像计时器
+			// 收到停止信号：先停止画像计时器，再将队列中剩余的条目并入批次后一次性写入
 			m.profileLock.Lock()
 			for _, profile := range m.portProfiles {
 				if profile.decisionTimer != nil {
@@ -181,15 +247,20 @@ func (m *FirewallSetManager) worker() {
 				}
 			}
 			m.profileLock.Unlock()
+		drain:
+			for {
+				select {
+				case item := <-m.queue:
+					m.addToBatch(batches, item)
+				default:
+					break drain
+				}
+			}
+			m.executeBatches(batches)
 			return
 
 		case item := <-m.queue:
-			key := m.batchKey(item)
-			dedupKey := fmt.Sprintf("%s:%d", item.ip, item.port)
-			if _, ok := batches[key]; !ok {
-				batches[key] = make(map[string]firewallAddItem)
-			}
-			batches[key][dedupKey] = item
+			key := m.addToBatch(batches, item)
 			if len(batches) == 1 && len(batches[key]) == 1 {
 				batchTimer.Reset(m.maxBatchWait)
 			}
@@ -222,12 +293,27 @@ func (m *FirewallSetManager) worker() {
 	}
 }
 
+// addToBatch 将条目按 (类型, set) 分组并按 ip:port 去重，返回批次 key
+func (m *FirewallSetManager) addToBatch(batches map[string]map[string]firewallAddItem, item firewallAddItem) string {
+	key := m.batchKey(item)
+	dedupKey := fmt.Sprintf("%s:%d", item.ip, item.port)
+	if _, ok := batches[key]; !ok {
+		batches[key] = make(map[string]firewallAddItem)
+	}
+	batches[key][dedupKey] = item
+	return key
+}
+
 func (m *FirewallSetManager) executeBatches(batches map[string]map[string]firewallAddItem) {
 	if len(batches) == 0 {
 		return
 	}
 
 	m.log.Debugf("[Manager] Executing %d batches...", len(batches))
+	if m.settings.Load().dryRun {
+		m.dryRunBatches(batches)
+		return
+	}
 
 	for key, itemsMap := range batches {
 		if len(itemsMap) == 0 {
@@ -308,7 +394,36 @@ func (m *FirewallSetManager) executeBatches(batches map[string]map[string]firewa
 	}
 }
 
+// dryRunBatches 记录本应加入防火墙 set 的条目；条目在超时前视为已卸载，不重复计数
+func (m *FirewallSetManager) dryRunBatches(batches map[string]map[string]firewallAddItem) {
+	now := time.Now()
+	for batch, items := range batches {
+		for dedupKey, item := range items {
+			key := batch + " " + dedupKey
+			if expires, ok := m.dryRunSet[key]; ok && now.Before(expires) {
+				continue
+			}
+			timeout := time.Duration(item.timeout) * time.Second
+			if item.timeout <= 0 {
+				timeout = 24 * time.Hour
+			}
+			m.dryRunSet[key] = now.Add(timeout)
+			m.dryRunOffloads.Add(1)
+			m.log.Debugf("[Manager] [dry-run] Would offload %s:%d to %s set %s (timeout %ds)", item.ip, item.port, item.fwType, item.setName, item.timeout)
+		}
+	}
+}
+
+// DryRunOffloads 返回空跑模式下本应卸载的条目数
+func (m *FirewallSetManager) DryRunOffloads() uint64 {
+	if m == nil {
+		return 0
+	}
+	return m.dryRunOffloads.Load()
+}
+
 func (m *FirewallSetManager) handleHttpEvent(ip string, port int) {
+	settings := m.settings.Load()
 	m.profileLock.Lock()
 	defer m.profileLock.Unlock()
 
@@ -327,7 +442,7 @@ func (m *FirewallSetManager) handleHttpEvent(ip string, port int) {
 	m.log.Debugf("[Manager] HTTP event for %s, resetting score and setting cooldown.", key)
 	// 重置非HTTP分数，设置新的豁免期
 	profile.nonHttpScore = 0
-	profile.httpLockExpires = time.Now().Add(m.httpCooldownPeriod)
+	profile.httpLockExpires = time.Now().Add(settings.httpCooldownPeriod)
 	profile.lastEvent = time.Now()
 
 	// 如果存在决策计时器，说明之前已满足非HTTP条件，现在取消
@@ -339,6 +454,7 @@ func (m *FirewallSetManager) handleHttpEvent(ip string, port int) {
 }
 
 func (m *FirewallSetManager) handleNonHttpEvent(ip string, port int) {
+	settings := m.settings.Load()
 	m.profileLock.Lock()
 	defer m.profileLock.Unlock()
 
@@ -361,12 +477,12 @@ func (m *FirewallSetManager) handleNonHttpEvent(ip string, port int) {
 	m.log.Debugf("[Manager] Non-HTTP event for %s, score is now %d.", key, profile.nonHttpScore)
 
 	// 检查是否达到阈值
-	if profile.nonHttpScore >= m.nonHttpThreshold {
-		if profile.nonHttpScore >= m.nonHttpThreshold {
+	if profile.nonHttpScore >= settings.nonHttpThreshold {
+		if profile.nonHttpScore >= settings.nonHttpThreshold {
 			//  如果已存在，就让它继续运行，不要重置。
 			if profile.decisionTimer == nil {
-				m.log.Infof("[Manager] Threshold reached for %s. Starting decision timer (%s).", key, m.decisionDelay)
-				profile.decisionTimer = time.AfterFunc(m.decisionDelay, func() {
+				m.log.Infof("[Manager] Threshold reached for %s. Starting decision timer (%s).", key, settings.decisionDelay)
+				profile.decisionTimer = time.AfterFunc(settings.decisionDelay, func() {
 					m.finalizeDecision(ip, port)
 				})
 			}
@@ -375,6 +491,7 @@ func (m *FirewallSetManager) handleNonHttpEvent(ip string, port int) {
 }
 
 func (m *FirewallSetManager) finalizeDecision(ip string, port int) {
+	settings := m.settings.Load()
 	m.profileLock.Lock()
 	defer m.profileLock.Unlock()
 
@@ -382,7 +499,7 @@ func (m *FirewallSetManager) finalizeDecision(ip string, port int) {
 	profile, ok := m.portProfiles[key]
 
 	// 再次检查条件，如果在延迟期间收到了HTTP事件，profile可能已被修改或删除
-	if !ok || profile.nonHttpScore < m.nonHttpThreshold || time.Now().Before(profile.httpLockExpires) {
+	if !ok || profile.nonHttpScore < settings.nonHttpThreshold || time.Now().Before(profile.httpLockExpires) {
 		m.log.Infof("[Manager] Final decision for %s aborted (conditions no longer met).", key)
 		if ok {
 			profile.decisionTimer = nil
@@ -391,7 +508,7 @@ func (m *FirewallSetManager) finalizeDecision(ip string, port int) {
 	}
 
 	m.log.Infof("[Manager] Decision final for %s. Adding to firewall.", key)
-	m.Add(ip, port, m.firewallIPSetName, m.firewallType, m.defaultTimeout)
+	m.Add(ip, port, settings.firewallIPSetName, settings.firewallType, settings.defaultTimeout)
 
 	// 从画像中删除，防止重复添加
 	delete(m.portProfiles, key)
@@ -422,4 +539,9 @@ func (m *FirewallSetManager) cleanupProfiles() {
 	if cleanedCount > 0 {
 		m.log.Debugf("[Manager] Cleaned up %d stale port profiles.", cleanedCount)
 	}
+	for key, expires := range m.dryRunSet {
+		if now.After(expires) {
+			delete(m.dryRunSet, key)
+		}
+	}
 }
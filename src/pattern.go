@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dlclark/regexp2"
+)
+
+// 正则引擎
+const (
+	RegexEngineRE2     = "re2"     // 标准库 regexp，线性时间，不支持环视与反向引用
+	RegexEngineRegexp2 = "regexp2" // 支持环视与反向引用，匹配有超时限制
+)
+
+// uaPattern 屏蔽两种正则引擎的差异，匹配与部分替换的语义保持一致
+// 匹配超时 (仅 regexp2) 时返回错误，调用方不能把结果当作 "不匹配" 缓存
+type uaPattern interface {
+	MatchString(s string) (bool, error)
+	// ReplaceAllString 替换所有匹配，repl 中可以使用 $1、${name}，两种引擎都按 regexp.Expand 的规则解释
+	ReplaceAllString(src, repl string) (string, error)
+	String() string
+}
+
+// patternCompiler 按配置的引擎编译正则
+type patternCompiler struct {
+	engine  string
+	timeout time.Duration
+}
+
+// Compile 编译正则，pattern 应自带 (?i) 等标志
+func (c patternCompiler) Compile(pattern string) (uaPattern, error) {
+	switch c.engine {
+	case RegexEngineRE2:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re2Pattern{re: re}, nil
+	case RegexEngineRegexp2:
+		re, err := regexp2.Compile(pattern, regexp2.RE2)
+		if err != nil {
+			return nil, err
+		}
+		re.MatchTimeout = c.timeout
+		return &regexp2Pattern{re: re, groups: captureOrder(pattern, re)}, nil
+	}
+	return nil, fmt.Errorf("unknown regex engine: %s", c.engine)
+}
+
+// re2Pattern 适配标准库 regexp，匹配不会失败
+type re2Pattern struct {
+	re *regexp.Regexp
+}
+
+func (p re2Pattern) MatchString(s string) (bool, error) {
+	return p.re.MatchString(s), nil
+}
+
+func (p re2Pattern) ReplaceAllString(src, repl string) (string, error) {
+	return p.re.ReplaceAllString(src, repl), nil
+}
+
+func (p re2Pattern) String() string {
+	return p.re.String()
+}
+
+// regexp2Pattern 适配 regexp2；超过 MatchTimeout 时返回错误
+type regexp2Pattern struct {
+	re     *regexp2.Regexp
+	groups []int // 按 RE2 的编号顺序 (左括号出现的顺序) 排列的 regexp2 分组编号
+}
+
+func (p *regexp2Pattern) MatchString(s string) (bool, error) {
+	return p.re.MatchString(s)
+}
+
+// ReplaceAllString 按标准库 regexp.Expand 的规则解释 repl，结果与 re2 引擎一致
+func (p *regexp2Pattern) ReplaceAllString(src, repl string) (string, error) {
+	return p.re.Replace(src, p.substitution(repl), -1, -1)
+}
+
+// substitution 将 RE2 风格的替换模板转换为 regexp2 (.NET) 的替换语法：
+// $name 取最长的字母、数字、下划线序列 ($1x 是名为 1x 的分组)，不存在的分组替换为空，
+// 不构成引用的 $ 按原样输出；regexp2 中命名分组排在未命名分组之后编号，数字引用按 RE2 的编号转换
+func (p *regexp2Pattern) substitution(repl string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(repl, '$')
+		if i < 0 {
+			b.WriteString(repl)
+			return b.String()
+		}
+		b.WriteString(repl[:i])
+		repl = repl[i:]
+		if strings.HasPrefix(repl, "$$") {
+			b.WriteString("$$")
+			repl = repl[2:]
+			continue
+		}
+		name, rest, ok := templateName(repl[1:])
+		if !ok {
+			b.WriteString("$$")
+			repl = repl[1:]
+			continue
+		}
+		repl = rest
+		group := -1
+		if num, err := strconv.Atoi(name); err == nil {
+			if num < len(p.groups) {
+				group = p.groups[num]
+			}
+		} else {
+			group = p.re.GroupNumberFromName(name)
+		}
+		if group >= 0 {
+			b.WriteString("${" + strconv.Itoa(group) + "}")
+		}
+	}
+}
+
+// templateName 解析 $ 之后的 name 或 {name}，规则与 regexp.Expand 相同
+func templateName(s string) (name string, rest string, ok bool) {
+	brace := strings.HasPrefix(s, "{")
+	if brace {
+		s = s[1:]
+	}
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	if end == 0 {
+		return "", "", false
+	}
+	name, rest = s[:end], s[end:]
+	if brace {
+		if !strings.HasPrefix(rest, "}") {
+			return "", "", false
+		}
+		rest = rest[1:]
+	}
+	return name, rest, true
+}
+
+// captureOrder 按左括号出现的顺序列出捕获分组在 regexp2 中的编号 (下标 0 为整个匹配)
+// 无法可靠解析时按 regexp2 自身的编号
+func captureOrder(pattern string, re *regexp2.Regexp) []int {
+	order := []int{0}
+	unnamed := 0
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+			// 紧跟 [ 或 [^ 的 ] 是字面字符
+			if strings.HasPrefix(pattern[i+1:], "^") {
+				i++
+			}
+			if strings.HasPrefix(pattern[i+1:], "]") {
+				i++
+			}
+		case c == '(' && strings.HasPrefix(pattern[i+1:], "?"):
+			rest := pattern[i+2:]
+			var name string
+			switch {
+			case strings.HasPrefix(rest, "P<"):
+				name, _, _ = strings.Cut(rest[2:], ">")
+			case strings.HasPrefix(rest, "<") && !strings.HasPrefix(rest, "<=") && !strings.HasPrefix(rest, "<!"):
+				name, _, _ = strings.Cut(rest[1:], ">")
+			case strings.HasPrefix(rest, "'"):
+				name, _, _ = strings.Cut(rest[1:], "'")
+			default:
+				// 非捕获分组、环视与标志
+				continue
+			}
+			order = append(order, re.GroupNumberFromName(name))
+		case c == '(':
+			unnamed++
+			order = append(order, unnamed)
+		}
+	}
+	if len(order) != len(re.GetGroupNumbers()) {
+		return re.GetGroupNumbers()
+	}
+	return order
+}
+
+func (p *regexp2Pattern) String() string {
+	return p.re.String()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPatternEnginesReplaceAlike(t *testing.T) {
+	re2 := patternCompiler{engine: RegexEngineRE2}
+	regexp2 := patternCompiler{engine: RegexEngineRegexp2, timeout: time.Second}
+	ua := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) Mobile/15E148"
+	tests := []struct {
+		pattern string
+		repl    string
+	}{
+		{`(iPhone|Android)`, `X`},
+		{`(iPhone) OS (\d+)`, `$1-$2`},
+		{`(iPhone) OS (\d+)`, `${1}x ${2}`},
+		{`(iPhone) OS (\d+)`, `$1x`},            // 名为 1x 的分组不存在
+		{`(iPhone) OS (\d+)`, `$$1 $ $& $' $+`}, // 字面 $
+		{`(iPhone) OS (\d+)`, `$3 ${9} ${nope}`},
+		{`(?P<dev>iPhone) OS (\d+)`, `$1/$2/${dev}/$dev`},
+		{`(a)?(?P<dev>iPhone)( OS)`, `[$1|$2|$3|${dev}]`},
+		{`(?:CPU )(?P<dev>iPhone)`, `$1 ${dev}x ${dev`},
+		{`[()](iPhone)`, `<$1>`},
+		{`[^(\]](iPhone) OS`, `<$1>`},
+		{`\((iPhone)`, `{$1}`},
+	}
+	for _, tt := range tests {
+		want, err := mustCompile(t, re2, tt.pattern).ReplaceAllString(ua, tt.repl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mustCompile(t, regexp2, tt.pattern).ReplaceAllString(ua, tt.repl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s / %s: regexp2 %q, re2 %q", tt.pattern, tt.repl, got, want)
+		}
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	for _, engine := range []string{RegexEngineRE2, RegexEngineRegexp2} {
+		c := patternCompiler{engine: engine, timeout: time.Second}
+		p := mustCompile(t, c, `(?i)android`)
+		for ua, want := range map[string]bool{"Linux; Android 14": true, "ANDROID": true, "iPhone": false} {
+			if got, err := p.MatchString(ua); err != nil || got != want {
+				t.Errorf("%s: MatchString(%q) = %v, %v; want %v", engine, ua, got, err, want)
+			}
+		}
+	}
+	if _, err := (patternCompiler{engine: "pcre"}).Compile("x"); err == nil {
+		t.Error("unknown engine accepted")
+	}
+	if _, err := (patternCompiler{engine: RegexEngineRE2}).Compile(`Windows(?!.*Xbox)`); err == nil {
+		t.Error("re2 accepted lookahead")
+	}
+	if _, err := (patternCompiler{engine: RegexEngineRegexp2, timeout: time.Second}).Compile(`Windows(?!.*Xbox)`); err != nil {
+		t.Errorf("regexp2 rejected lookahead: %v", err)
+	}
+}
+
+func mustCompile(t *testing.T, c patternCompiler, pattern string) uaPattern {
+	t.Helper()
+	p, err := c.Compile(pattern)
+	if err != nil {
+		t.Fatalf("%s: %v", pattern, err)
+	}
+	return p
+}
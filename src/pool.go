@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 队列等待超时后的处理方式
+const (
+	PoolOverflowGoroutine = "goroutine" // 交给临时 goroutine 处理
+	PoolOverflowReject    = "reject"    // 以 RST 拒绝连接
+)
+
+const (
+	poolScaleInterval = 1 * time.Second
+	poolIdleRounds    = 30 // 连续空闲多少个周期后缩容
+)
+
+type queuedConn struct {
+	conn     *net.TCPConn
+	enqueued time.Time
+}
+
+// PoolMetrics 是协程池的运行指标快照
+type PoolMetrics struct {
+	Workers   int           // 当前 worker 数
+	Busy      int           // 正在处理连接的 worker 数
+	Queued    int           // 排队中的连接数
+	WaitTotal time.Duration // 累计排队等待时间
+	WaitCount uint64        // 累计出队连接数
+	Overflow  uint64        // 超时后交给临时 goroutine 的连接数
+	Rejected  uint64        // 超时后被拒绝的连接数
+}
+
+// WorkerPool 是可在 [min, max] 之间自动伸缩的连接处理协程池
+type WorkerPool struct {
+	name     string
+	handle   func(*net.TCPConn)
+	reject   func(*net.TCPConn)
+	queue    chan queuedConn
+	shrink   chan struct{}
+	stop     chan struct{} // Stop 关闭，通知伸缩协程退出
+	min      int
+	max      int
+	maxWait  time.Duration
+	overflow string
+
+	nextID    atomic.Int64
+	workers   atomic.Int64
+	busy      atomic.Int64
+	waitTotal atomic.Int64
+	waitCount atomic.Uint64
+	overflows atomic.Uint64
+	rejects   atomic.Uint64
+}
+
+func NewWorkerPool(name string, min, max, queueSize int, maxWait time.Duration, overflow string, handle, reject func(*net.TCPConn)) *WorkerPool {
+	return &WorkerPool{
+		name:     name,
+		handle:   handle,
+		reject:   reject,
+		queue:    make(chan queuedConn, queueSize),
+		shrink:   make(chan struct{}),
+		stop:     make(chan struct{}),
+		min:      min,
+		max:      max,
+		maxWait:  maxWait,
+		overflow: overflow,
+	}
+}
+
+// Start 启动初始 worker 与伸缩协程
+func (p *WorkerPool) Start(size int) {
+	for i := 0; i < size; i++ {
+		p.spawn()
+	}
+	if p.max > p.min {
+		go p.autoscale()
+	}
+}
+
+// Stop 停止伸缩协程并关闭队列，worker 处理完已排队的连接后退出
+// 必须在所有 Submit 返回 (Accept 循环退出) 之后调用
+func (p *WorkerPool) Stop() {
+	close(p.stop)
+	close(p.queue)
+}
+
+// Submit 将连接放入队列；队列已满时先尝试扩容，等待超过 maxWait 后按 overflow 策略处理
+func (p *WorkerPool) Submit(conn *net.TCPConn) {
+	item := queuedConn{conn: conn, enqueued: time.Now()}
+	select {
+	case p.queue <- item:
+		return
+	default:
+	}
+
+	// 队列已满，未达上限时立即扩容
+	p.tryGrow()
+	if p.maxWait <= 0 {
+		p.queue <- item
+		return
+	}
+
+	timer := time.NewTimer(p.maxWait)
+	defer timer.Stop()
+	select {
+	case p.queue <- item:
+	case <-timer.C:
+		if p.overflow == PoolOverflowReject {
+			p.rejects.Add(1)
+			logrus.Debugf("[Pool] %s queue wait exceeded %s, rejecting %s", p.name, p.maxWait, conn.RemoteAddr())
+			p.reject(conn)
+			return
+		}
+		p.overflows.Add(1)
+		logrus.Debugf("[Pool] %s queue wait exceeded %s, handing %s to a temporary goroutine", p.name, p.maxWait, conn.RemoteAddr())
+		go p.handle(conn)
+	}
+}
+
+// Metrics 返回当前指标快照
+func (p *WorkerPool) Metrics() PoolMetrics {
+	return PoolMetrics{
+		Workers:   int(p.workers.Load()),
+		Busy:      int(p.busy.Load()),
+		Queued:    len(p.queue),
+		WaitTotal: time.Duration(p.waitTotal.Load()),
+		WaitCount: p.waitCount.Load(),
+		Overflow:  p.overflows.Load(),
+		Rejected:  p.rejects.Load(),
+	}
+}
+
+// tryGrow 在未达上限时增加一个 worker
+func (p *WorkerPool) tryGrow() bool {
+	for {
+		n := p.workers.Load()
+		if n >= int64(p.max) {
+			return false
+		}
+		if p.workers.CompareAndSwap(n, n+1) {
+			go p.worker(int(p.nextID.Add(1)))
+			return true
+		}
+	}
+}
+
+func (p *WorkerPool) spawn() {
+	p.workers.Add(1)
+	go p.worker(int(p.nextID.Add(1)))
+}
+
+func (p *WorkerPool) worker(workerID int) {
+	for {
+		select {
+		case item, ok := <-p.queue:
+			if !ok {
+				p.workers.Add(-1)
+				logrus.Debugf("[server] Worker %s-%d stopping (pool stopped)", p.name, workerID)
+				return
+			}
+			p.waitTotal.Add(int64(time.Since(item.enqueued)))
+			p.waitCount.Add(1)
+			p.busy.Add(1)
+			logrus.Debugf("[server] Worker %s-%d processing connection from %s", p.name, workerID, item.conn.RemoteAddr())
+			p.handle(item.conn)
+			p.busy.Add(-1)
+		case <-p.shrink:
+			p.workers.Add(-1)
+			logrus.Debugf("[server] Worker %s-%d stopping (pool shrink)", p.name, workerID)
+			return
+		}
+	}
+}
+
+// autoscale 根据排队与空闲情况在 [min, max] 之间调整 worker 数
+func (p *WorkerPool) autoscale() {
+	ticker := time.NewTicker(poolScaleInterval)
+	defer ticker.Stop()
+
+	idleRounds := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+		workers := int(p.workers.Load())
+		busy := int(p.busy.Load())
+		queued := len(p.queue)
+
+		// 扩容：有连接在排队
+		if queued > 0 && workers < p.max {
+			grow := queued
+			if workers+grow > p.max {
+				grow = p.max - workers
+			}
+			for i := 0; i < grow; i++ {
+				p.tryGrow()
+			}
+			idleRounds = 0
+			logrus.Debugf("[Pool] %s grew by %d workers (now %d, queued %d)", p.name, grow, workers+grow, queued)
+			continue
+		}
+
+		// 缩容：超过一半 worker 持续空闲
+		if queued == 0 && busy*2 < workers && workers > p.min {
+			idleRounds++
+		} else {
+			idleRounds = 0
+		}
+		if idleRounds < poolIdleRounds {
+			continue
+		}
+		idleRounds = 0
+		target := busy * 2
+		if target < p.min {
+			target = p.min
+		}
+		shrunk := 0
+		for i := 0; i < workers-target; i++ {
+			select {
+			case p.shrink <- struct{}{}:
+				shrunk++
+			default:
+			}
+		}
+		if shrunk > 0 {
+			logrus.Debugf("[Pool] %s shrank by %d workers (now %d)", p.name, shrunk, workers-shrunk)
+		}
+	}
+}
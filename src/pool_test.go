@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolStop(t *testing.T) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer listener.Close()
+	conns := make([]*net.TCPConn, 3)
+	for i := range conns {
+		client, err := net.Dial("tcp4", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if conns[i], err = listener.AcceptTCP(); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+
+	before := runtime.NumGoroutine()
+	handled := make(chan struct{}, 4)
+	handle := func(conn *net.TCPConn) { handled <- struct{}{} }
+	pool := NewWorkerPool("T", 1, 4, 4, 0, PoolOverflowGoroutine, handle, handle)
+	pool.Start(2)
+
+	// 已排队的连接在 Stop 之后仍会被处理
+	for _, conn := range conns {
+		pool.Submit(conn)
+	}
+	pool.Stop()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("queued connection not handled after Stop")
+		}
+	}
+
+	// worker 与伸缩协程全部退出
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines still running after Stop", n-before)
+	}
+	if workers := pool.Metrics().Workers; workers != 0 {
+		t.Errorf("workers = %d after Stop, want 0", workers)
+	}
+}
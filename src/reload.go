@@ -0,0 +1,55 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader 重新解析启动参数 (含参数文件)，并将新配置应用到运行中的组件
+// 已建立的连接不受影响，新请求使用新配置
+type Reloader struct {
+	mu        sync.Mutex
+	handler   *HTTPHandler
+	fwManager *FirewallSetManager
+}
+
+func NewReloader(handler *HTTPHandler, fwManager *FirewallSetManager) *Reloader {
+	return &Reloader{
+		handler:   handler,
+		fwManager: fwManager,
+	}
+}
+
+// Reload 重新读取配置；解析失败时保留当前配置
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.handler.config.Load()
+	cfg, err := NewConfig(old.Args)
+	if err != nil {
+		logrus.Errorf("[Reload] Failed to reload config, keeping current settings: %v", err)
+		return err
+	}
+
+	if changed := old.staticChanges(cfg); len(changed) > 0 {
+		logrus.Warnf("[Reload] Changes to %s require a restart and were ignored", strings.Join(changed, ", "))
+		cfg.keepStatic(old)
+	}
+
+	if level, err := logrus.ParseLevel(cfg.LogLevel); err == nil {
+		logrus.SetLevel(level)
+	}
+	if cfg.GCPercent > 0 && cfg.GCPercent != old.GCPercent {
+		debug.SetGCPercent(cfg.GCPercent)
+	}
+	r.handler.ApplyConfig(cfg)
+	r.fwManager.ApplyConfig(cfg)
+
+	logrus.Info("[Reload] Configuration reloaded")
+	cfg.LogConfig(version)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errNotTextMessage = errors.New("not a RTSP/SIP message")
+	errDropConnection = errors.New("connection dropped by firewall UA whitelist")
+)
+
+// forwardTextProtocol 处理 RTSP / SIP over TCP 连接：逐条解析消息，改写 User-Agent 后转发
+// 消息格式与 HTTP/1 相同 (起始行 + 头部 + Content-Length 指定长度的消息体)
+// RTSP interleaved 二进制帧 ($ + 通道 + 长度) 与 SIP 的 CRLF 保活原样转发
+func (h *HTTPHandler) forwardTextProtocol(proto Protocol, srcReader *bufio.Reader, dstWriter *bufio.Writer, destAddrPort string, destIP string, destPort int, srcIP string) error {
+	tp := textproto.NewReader(srcReader)
+	for {
+		first, err := srcReader.Peek(1)
+		if err != nil {
+			return err
+		}
+		switch {
+		case proto == ProtoRTSP && first[0] == '$':
+			header, err := srcReader.Peek(4)
+			if err != nil {
+				return err
+			}
+			frameLen := 4 + int64(binary.BigEndian.Uint16(header[2:4]))
+			if _, err := io.CopyN(dstWriter, srcReader, frameLen); err != nil {
+				return err
+			}
+		case first[0] == '\r' || first[0] == '\n':
+			b, _ := srcReader.ReadByte()
+			if err := dstWriter.WriteByte(b); err != nil {
+				return err
+			}
+		default:
+			if err := h.forwardTextMessage(proto, tp, srcReader, dstWriter, destAddrPort, destIP, destPort, srcIP); err != nil {
+				return err
+			}
+		}
+
+		// 没有后续数据时立即刷新，避免请求滞留
+		if srcReader.Buffered() == 0 {
+			if err := dstWriter.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// forwardTextMessage 转发一条 RTSP/SIP 消息 (请求或响应)
+func (h *HTTPHandler) forwardTextMessage(proto Protocol, tp *textproto.Reader, srcReader *bufio.Reader, dstWriter *bufio.Writer, destAddrPort string, destIP string, destPort int, srcIP string) error {
+	version := strings.ToUpper(string(proto)) + "/"
+
+	startLine, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	isRequest := false
+	if sp := strings.LastIndexByte(startLine, ' '); sp > 0 && strings.HasPrefix(startLine[sp+1:], version) {
+		isRequest = true
+	} else if !strings.HasPrefix(startLine, version) {
+		logrus.Debugf("[Handler] [%s] Unexpected %s start line: %q", destAddrPort, proto, startLine)
+		if _, err := dstWriter.WriteString(startLine + "\r\n"); err != nil {
+			return err
+		}
+		return errNotTextMessage
+	}
+	if _, err := dstWriter.WriteString(startLine + "\r\n"); err != nil {
+		return err
+	}
+
+	if isRequest {
+		h.stats.IncHttpRequests()
+		if h.config.Load().EnableFirewallUABypass {
+			// 携带 UA 的文本协议同样需要保留在代理中
+			h.fwManager.ReportHttpEvent(destIP, destPort)
+		}
+	}
+
+	var contentLength int64
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			name = strings.TrimSpace(name)
+			switch {
+			case strings.EqualFold(name, "User-Agent"):
+				uaStr := strings.TrimSpace(value)
+				if uaStr != "" {
+					decision := h.processUA(uaStr, destAddrPort, destIP, destPort, srcIP, "")
+					if decision.drop {
+						return errDropConnection
+					}
+					line = name + ": " + decision.finalUA
+				}
+			case strings.EqualFold(name, "Content-Length") || (proto == ProtoSIP && strings.EqualFold(name, "l")):
+				// SIP 允许 Content-Length 的紧凑形式 "l"，头部名称不区分大小写
+				n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+				if err != nil || n < 0 {
+					logrus.Debugf("[Handler] [%s] Invalid %s Content-Length: %q", destAddrPort, proto, value)
+					return errNotTextMessage
+				}
+				contentLength = n
+			}
+		}
+		if _, err := dstWriter.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := dstWriter.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	if contentLength > 0 {
+		if _, err := io.CopyN(dstWriter, srcReader, contentLength); err != nil {
+			return err
+		}
+	}
+	logrus.Debugf("[Handler] [%s] %s message processed, body size: %d", destAddrPort, proto, contentLength)
+	return nil
+}
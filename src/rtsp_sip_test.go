@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestForwardTextProtocolBodyLength(t *testing.T) {
+	h := newTestHandler(t, "-u", "Masked-UA", "-force")
+	// 消息体中的 "User-Agent:" 行不能被当作下一条消息的头部改写
+	body := "User-Agent: in-body\r\n"
+	tests := []struct {
+		name   string
+		proto  Protocol
+		header string
+	}{
+		{"sip compact", ProtoSIP, "l: 21"},
+		{"sip compact upper", ProtoSIP, "L: 21"},
+		{"sip full mixed case", ProtoSIP, "content-LENGTH: 21"},
+		{"rtsp", ProtoRTSP, "Content-Length: 21"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := strings.ToUpper(string(tt.proto)) + "/"
+			first := "OPTIONS sip:a@b " + version + "2.0\r\nUser-Agent: Phone/1.0\r\n" + tt.header + "\r\n\r\n" + body
+			second := "OPTIONS sip:a@b " + version + "2.0\r\nUser-Agent: Phone/2.0\r\n\r\n"
+			var out bytes.Buffer
+			w := bufio.NewWriter(&out)
+			err := h.forwardTextProtocol(tt.proto, bufio.NewReader(strings.NewReader(first+second)), w, "192.0.2.1:5060", "192.0.2.1", 5060, "")
+			w.Flush()
+			if err != io.EOF {
+				t.Fatalf("forward error: %v", err)
+			}
+			got := out.String()
+			if !strings.Contains(got, "\r\n\r\n"+body+"OPTIONS") {
+				t.Errorf("message body not forwarded intact:\n%s", got)
+			}
+			if strings.Contains(got, "Phone/") || strings.Count(got, "User-Agent: Masked-UA") != 2 {
+				t.Errorf("User-Agent not rewritten in both messages:\n%s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 规则文件 (-rules) 格式：每行一条规则，按顺序匹配，第一条命中的规则生效
+//
+//	[name=<名称>] <条件>... <动作>
+//
+// 条件之间为「与」关系；同一条件的多个值用逗号分隔，任一命中即可；key!=value 表示取反
+//
+//	ua=<关键词>       UA 包含关键词
+//	ua-regex=<正则>   UA 匹配正则 (不区分大小写，引擎由 -regex-engine 指定)
+//	host=<域名>       Host 为该域名或其子域名，*.example.com 仅匹配子域名
+//	dst=<IP/CIDR>     目标地址
+//	dport=<端口|a-b>  目标端口
+//	src=<IP/CIDR>     客户端地址
+//	os=<系统>         内置解析器识别的系统，如 os=[iOS,Android] (见 uaparse.go)
+//	os-version=<版本> 系统版本，17 匹配 17、17.1 等
+//	device=<类型>     mobile, tablet, desktop, tv, console, bot, other
+//	browser=<浏览器>  browser-version=<版本>  engine=<内核>
+//
+// 动作：replace ["新 UA"] (省略时使用 -u，可使用 {os} {browser_version} 等占位符)、pass、offload、drop
+// 例：ua=Android host!=*.campus.edu replace
+//
+// 值可以使用单双引号，# 之后为注释；未命中任何规则时使用原有的白名单与匹配模式
+
+// 规则动作
+const (
+	RuleActionReplace = "replace" // 替换 UA
+	RuleActionPass    = "pass"    // 不修改
+	RuleActionOffload = "offload" // 不修改并加入防火墙 set 卸载
+	RuleActionDrop    = "drop"    // 断开连接
+)
+
+var ruleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ruleRequest 是规则匹配所需的请求信息
+type ruleRequest struct {
+	ua      string
+	host    string // 小写、不含端口；RTSP/SIP 等无 Host 时为空
+	srcIP   net.IP
+	dstIP   net.IP
+	dstPort int
+	info    *uaInfo // 按需解析
+	err     error   // 正则匹配超时，此时匹配结果不可信
+}
+
+// uaInfo 返回 UA 的解析结果，多个字段条件共用一次解析
+func (req *ruleRequest) uaInfo() *uaInfo {
+	if req.info == nil {
+		info := parseUA(req.ua)
+		req.info = &info
+	}
+	return req.info
+}
+
+// ruleCondition 是单个匹配条件
+type ruleCondition struct {
+	negate bool
+	match  func(req *ruleRequest) bool
+}
+
+// Rule 是规则文件中的一条规则
+type Rule struct {
+	Name        string
+	Action      string
+	Replacement string // replace 动作的新 UA，为空时使用 -u
+	conditions  []ruleCondition
+}
+
+// Match 判断请求是否满足规则的全部条件
+func (r *Rule) Match(req *ruleRequest) bool {
+	for _, c := range r.conditions {
+		if c.match(req) == c.negate || req.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchRules 返回第一条命中的规则，没有命中时返回 nil
+// 正则匹配超时时停止匹配并返回错误
+func MatchRules(rules []*Rule, req *ruleRequest) (*Rule, error) {
+	for _, r := range rules {
+		if r.Match(req) {
+			return r, nil
+		}
+		if req.err != nil {
+			return nil, req.err
+		}
+	}
+	return nil, nil
+}
+
+// LoadRules 读取并解析规则文件
+func LoadRules(path string, compiler patternCompiler) ([]*Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+	defer file.Close()
+	rules, err := parseRules(file, compiler)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func parseRules(r io.Reader, compiler patternCompiler) ([]*Rule, error) {
+	var rules []*Rule
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		tokens, err := uciTokens(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		rule, err := parseRule(tokens, compiler)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("line%d", lineNo)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("line %d: duplicate rule name %q", lineNo, rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseRule 解析一行规则的 token
+func parseRule(tokens []string, compiler patternCompiler) (*Rule, error) {
+	rule := &Rule{}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		key, value, isCond := strings.Cut(token, "=")
+		if !isCond {
+			// 动作必须位于最后 (replace 之后可跟新 UA)
+			rule.Action = token
+			rest := tokens[i+1:]
+			switch token {
+			case RuleActionReplace:
+				if len(rest) > 1 {
+					return nil, fmt.Errorf("unexpected %q after replacement", rest[1])
+				}
+				if len(rest) == 1 {
+					rule.Replacement = rest[0]
+				}
+			case RuleActionPass, RuleActionOffload, RuleActionDrop:
+				if len(rest) > 0 {
+					return nil, fmt.Errorf("unexpected %q after action %s", rest[0], token)
+				}
+			default:
+				return nil, fmt.Errorf("unknown action %q", token)
+			}
+			return rule, nil
+		}
+
+		if key == "name" {
+			if !ruleNamePattern.MatchString(value) {
+				return nil, fmt.Errorf("invalid rule name %q", value)
+			}
+			rule.Name = value
+			continue
+		}
+		negate := strings.HasSuffix(key, "!")
+		key = strings.TrimSuffix(key, "!")
+		match, err := parseRuleCondition(key, value, compiler)
+		if err != nil {
+			return nil, err
+		}
+		rule.conditions = append(rule.conditions, ruleCondition{negate: negate, match: match})
+	}
+	return nil, fmt.Errorf("missing action (replace, pass, offload or drop)")
+}
+
+// parseRuleCondition 将 key=value 转换为匹配函数
+func parseRuleCondition(key, value string, compiler patternCompiler) (func(req *ruleRequest) bool, error) {
+	if value == "" {
+		return nil, fmt.Errorf("empty value for %s", key)
+	}
+	switch key {
+	case "ua":
+		keywords := splitRuleValues(value)
+		return func(req *ruleRequest) bool {
+			for _, k := range keywords {
+				if strings.Contains(req.ua, k) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "ua-regex":
+		re, err := compiler.Compile("(?i)" + value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ua-regex: %w", err)
+		}
+		return func(req *ruleRequest) bool {
+			ok, err := re.MatchString(req.ua)
+			if err != nil {
+				req.err = err
+			}
+			return ok
+		}, nil
+	case "host":
+		domains := splitDomainList(value)
+		return func(req *ruleRequest) bool {
+			for _, d := range domains {
+				if matchDomainSuffix(req.host, d) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "dst", "src":
+		nets, err := parseRuleNets(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if key == "src" {
+			return func(req *ruleRequest) bool { return containsIP(nets, req.srcIP) }, nil
+		}
+		return func(req *ruleRequest) bool { return containsIP(nets, req.dstIP) }, nil
+	case "dport":
+		ranges, err := parsePortRanges(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *ruleRequest) bool {
+			for _, r := range ranges {
+				if req.dstPort >= r[0] && req.dstPort <= r[1] {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "os", "device", "browser", "engine":
+		values := splitRuleValues(strings.Trim(value, "[]"))
+		return func(req *ruleRequest) bool {
+			field := req.uaInfo().Field(key)
+			for _, v := range values {
+				if strings.EqualFold(field, v) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "os-version", "browser-version":
+		values := splitRuleValues(strings.Trim(value, "[]"))
+		return func(req *ruleRequest) bool {
+			field := req.uaInfo().Field(key)
+			for _, v := range values {
+				if field == v || strings.HasPrefix(field, v+".") {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown condition %q", key)
+}
+
+func splitRuleValues(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseRuleNets 解析逗号分隔的 IP 或 CIDR
+func parseRuleNets(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range splitRuleValues(value) {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRanges 解析逗号分隔的端口或 a-b 端口范围
+func parsePortRanges(value string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, v := range splitRuleValues(value) {
+		lo, hi, isRange := strings.Cut(v, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid dport %q", v)
+		}
+		ranges = append(ranges, [2]int{from, to})
+	}
+	return ranges, nil
+}
+
+// requestHost 返回不含端口的小写 Host
+func requestHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRuleCompiler = patternCompiler{engine: RegexEngineRE2}
+
+const (
+	uaIPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1"
+	uaWindows = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	uaAndroid = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.43 Mobile Safari/537.36"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+# 注释与空行被忽略
+name=tv device=tv pass
+ua=Android,iPhone host!=*.campus.edu replace "Masked {os}/{os_version}"
+dport=8000-8080 dst=10.0.0.0/8 offload # 行尾注释
+src='192.168.1.5' drop
+`), testRuleCompiler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, action, replacement string }{
+		{"tv", RuleActionPass, ""},
+		{"line4", RuleActionReplace, "Masked {os}/{os_version}"},
+		{"line5", RuleActionOffload, ""},
+		{"line6", RuleActionDrop, ""},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(want))
+	}
+	for i, w := range want {
+		if r := rules[i]; r.Name != w.name || r.Action != w.action || r.Replacement != w.replacement {
+			t.Errorf("rule %d = {%s %s %q}, want {%s %s %q}", i, r.Name, r.Action, r.Replacement, w.name, w.action, w.replacement)
+		}
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{"ua=Android", "missing action"},
+		{"ua=Android block", "unknown action"},
+		{"ua=Android pass now", "unexpected"},
+		{`ua=Android replace "a" "b"`, "unexpected"},
+		{"color=red pass", "unknown condition"},
+		{"ua= pass", "empty value"},
+		{"ua-regex=( pass", "invalid ua-regex"},
+		{"dst=10.0.0.300 pass", "invalid dst"},
+		{"src=::1/200 pass", "invalid src"},
+		{"dport=0 pass", "invalid dport"},
+		{"dport=90-80 pass", "invalid dport"},
+		{"dport=70000 pass", "invalid dport"},
+		{"name=a/b pass", "invalid rule name"},
+		{"name=x pass\nname=x drop", "line 2: duplicate rule name"},
+		{"ua='Android pass", "line 1"},
+	}
+	for _, tt := range tests {
+		_, err := parseRules(strings.NewReader(tt.rules), testRuleCompiler)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want %q", tt.rules, err, tt.err)
+		}
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+name=campus ua=Android host!=*.campus.edu replace
+name=not-windows ua-regex=windows os!=Windows pass
+name=ios-17 os=[iOS] os-version=17 browser!=Chrome replace
+name=lan src=192.168.1.0/24 dport=80,8000-8080 dst!=10.0.0.1 offload
+name=v6 dst=2001:db8::/32 drop
+`), testRuleCompiler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		req  ruleRequest
+		want string // 命中的规则名，未命中为空
+	}{
+		{"keyword", ruleRequest{ua: uaAndroid, host: "www.example.com"}, "campus"},
+		{"negated host excludes subdomain", ruleRequest{ua: uaAndroid, host: "wifi.campus.edu"}, ""},
+		{"negated wildcard keeps apex", ruleRequest{ua: uaAndroid, host: "campus.edu"}, "campus"},
+		{"negated condition with empty host", ruleRequest{ua: uaAndroid}, "campus"},
+		{"regex case-insensitive, negated os", ruleRequest{ua: "WINDOWS-Update-Agent"}, "not-windows"},
+		{"negated os excludes", ruleRequest{ua: uaWindows}, ""},
+		{"os and version prefix", ruleRequest{ua: uaIPhone}, "ios-17"},
+		{"version prefix must end at a dot", ruleRequest{ua: strings.Replace(uaIPhone, "OS 17_1", "OS 170_1", 1)}, ""},
+		{"address and port", ruleRequest{ua: "x", srcIP: net.ParseIP("192.168.1.7"), dstIP: net.ParseIP("10.0.0.2"), dstPort: 8080}, "lan"},
+		{"negated address", ruleRequest{ua: "x", srcIP: net.ParseIP("192.168.1.7"), dstIP: net.ParseIP("10.0.0.1"), dstPort: 80}, ""},
+		{"port outside range", ruleRequest{ua: "x", srcIP: net.ParseIP("192.168.1.7"), dstIP: net.ParseIP("10.0.0.2"), dstPort: 8081}, ""},
+		{"missing source address", ruleRequest{ua: "x", dstIP: net.ParseIP("10.0.0.2"), dstPort: 80}, ""},
+		{"ipv6 destination", ruleRequest{ua: "x", dstIP: net.ParseIP("2001:db8::1")}, "v6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			rule, err := MatchRules(rules, &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if rule != nil {
+				got = rule.Name
+			}
+			if got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchRulesRegexTimeout(t *testing.T) {
+	compiler := patternCompiler{engine: RegexEngineRegexp2, timeout: 10 * time.Millisecond}
+	rules, err := parseRules(strings.NewReader("name=slow ua-regex=(a+)+$ drop\nname=all ua=a pass"), compiler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 超时后不能继续匹配后面的规则，也不能当作不匹配
+	rule, err := MatchRules(rules, &ruleRequest{ua: strings.Repeat("a", 40) + "!"})
+	if rule != nil || err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("got rule %v, error %v; want a match timeout", rule, err)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"Example.COM":       "example.com",
+		"example.com:8080":  "example.com",
+		"example.com.":      "example.com",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"":                  "",
+	} {
+		if got := requestHost(host); got != want {
+			t.Errorf("requestHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
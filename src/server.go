@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -12,71 +13,204 @@ import (
 type Server struct {
 	config  *Config
 	handler *HTTPHandler
+
+	mu        sync.Mutex
+	listeners []*net.TCPListener
+	conns     map[net.Conn]struct{} // 活跃的客户端与上游连接，用于强制关闭
+	forced    bool                  // 已强制关闭所有连接
+	connWG    sync.WaitGroup        // 已接受但尚未处理完的连接
+	closing   atomic.Bool
 }
 
 func NewServer(config *Config, handler *HTTPHandler) *Server {
 	return &Server{
 		config:  config,
 		handler: handler,
+		conns:   make(map[net.Conn]struct{}),
 	}
 }
 
 func (s *Server) Run() error {
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(0, 0, 0, 0), Port: s.config.Port})
+	// 平滑升级时沿用旧进程交出的监听器，不足时再新建
+	listeners, err := inheritedListeners()
 	if err != nil {
-		return fmt.Errorf("listen failed: %v", err)
+		return err
+	}
+	if len(listeners) > 0 {
+		logrus.Infof("Inherited %d listeners from previous process", len(listeners))
+	}
+	for i := len(listeners); i < s.config.Listeners; i++ {
+		listener, err := listenReusePort(s.config.Port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listen failed: %v", err)
+		}
+		listeners = append(listeners, listener)
 	}
-	defer listener.Close()
-	logrus.Infof("REDIRECT proxy server listening on 0.0.0.0:%d", s.config.Port)
+	listenerCount := len(listeners)
+	s.mu.Lock()
+	s.listeners = listeners
+	s.mu.Unlock()
+	defer s.closeListeners()
+	logrus.Infof("REDIRECT proxy server listening on 0.0.0.0:%d (%d listeners, SO_REUSEPORT)", s.config.Port, listenerCount)
 
+	var wg sync.WaitGroup
+	var pools []*WorkerPool
 	if s.config.PoolSize > 0 {
 		// --- Worker Pool 模式 ---
-		logrus.Infof("Starting in Worker Pool Mode (size: %d)", s.config.PoolSize)
-		connChan := make(chan *net.TCPConn, s.config.PoolSize)
-
-		// 启动指定数量的 worker goroutine
-		for i := 0; i < s.config.PoolSize; i++ {
-			go func(workerID int) {
-				for conn := range connChan {
-					logrus.Debugf("[server] Worker %d processing connection from %s", workerID, conn.RemoteAddr())
-					s.handleConnection(conn)
-				}
-				logrus.Debugf("[server] Worker %d stopping", workerID)
-			}(i)
-		}
-
-		// Accept 循环 (生产者)
-		for {
-			conn, err := listener.AcceptTCP()
-			if err != nil {
-				logrus.Warnf("Accept error: %v; retrying...", err)
-				time.Sleep(5 * time.Millisecond)
-				continue
+		if s.config.ShardPool {
+			// 每个监听器拥有独立的 worker 子集
+			size := max(s.config.PoolSize/listenerCount, 1)
+			poolMin := max(s.config.PoolMin/listenerCount, 1)
+			poolMax := max(s.config.PoolMax/listenerCount, size)
+			logrus.Infof("Starting in Worker Pool Mode (size: %d, sharded: %d workers per listener, range %d-%d)", size*listenerCount, size, poolMin, poolMax)
+			for i, listener := range listeners {
+				pool := s.newPool(fmt.Sprintf("L%d", i), size, poolMin, poolMax)
+				pools = append(pools, pool)
+				wg.Add(1)
+				go s.acceptLoop(&wg, listener, i, pool.Submit)
+			}
+			s.handler.stats.SetPoolSource(pools...)
+		} else {
+			logrus.Infof("Starting in Worker Pool Mode (size: %d, range %d-%d)", s.config.PoolSize, s.config.PoolMin, s.config.PoolMax)
+			pool := s.newPool("W", s.config.PoolSize, s.config.PoolMin, s.config.PoolMax)
+			pools = append(pools, pool)
+			for i, listener := range listeners {
+				wg.Add(1)
+				go s.acceptLoop(&wg, listener, i, pool.Submit)
 			}
-			connChan <- conn
+			s.handler.stats.SetPoolSource(pools...)
 		}
-
 	} else {
 		// --- 默认模式---
 		logrus.Info("Starting in Default Mode (one goroutine per connection)")
-		for {
-			conn, err := listener.AcceptTCP()
-			if err != nil {
-				logrus.Warnf("Accept error: %v; retrying...", err)
-				time.Sleep(5 * time.Millisecond)
-				continue
+		for i, listener := range listeners {
+			wg.Add(1)
+			go s.acceptLoop(&wg, listener, i, func(conn *net.TCPConn) { go s.handleConnection(conn) })
+		}
+	}
+
+	// 已开始接受连接，通知等待交接的旧进程
+	notifyReady()
+
+	// 所有 Accept 循环退出 (监听器被 Shutdown 关闭) 后停止协程池并返回
+	wg.Wait()
+	for _, pool := range pools {
+		pool.Stop()
+	}
+	return nil
+}
+
+// Shutdown 关闭监听器，等待进行中的连接在 timeout 内自然结束，超时后强制关闭剩余连接
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.closing.Store(true)
+	s.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+
+	logrus.Infof("[server] Draining %d active connections (timeout %s)", s.handler.stats.ActiveConnections.Load(), timeout)
+	select {
+	case <-done:
+		logrus.Info("[server] All connections drained")
+		return
+	case <-time.After(timeout):
+	}
+
+	s.mu.Lock()
+	s.forced = true
+	remaining := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	logrus.Warnf("[server] Drain timeout exceeded, force closed %d sockets", remaining)
+
+	// 关闭后转发协程会很快退出，仍为排队中的连接留出少量时间
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// Listeners 返回当前的监听器 (用于平滑升级时交给新进程)
+func (s *Server) Listeners() []*net.TCPListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listeners
+}
+
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// trackConn 登记 (add=true) 或注销连接；强制关闭后登记的连接会被立即关闭
+func (s *Server) trackConn(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.forced {
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+// rejectConnection 以 RST 拒绝连接 (协程池排队超时)
+func (s *Server) rejectConnection(conn *net.TCPConn) {
+	defer s.connWG.Done()
+	// SO_LINGER=0 使 Close 发送 RST
+	conn.SetLinger(0)
+	conn.Close()
+}
+
+// newPool 创建并启动一个以 handleConnection 处理连接的协程池
+func (s *Server) newPool(name string, size, poolMin, poolMax int) *WorkerPool {
+	pool := NewWorkerPool(name, poolMin, poolMax, size, s.config.PoolMaxWait, s.config.PoolOverflow, s.handleConnection, s.rejectConnection)
+	pool.Start(size)
+	return pool
+}
+
+// acceptLoop 是单个监听器的 Accept 循环 (生产者)
+func (s *Server) acceptLoop(wg *sync.WaitGroup, listener *net.TCPListener, listenerID int, dispatch func(*net.TCPConn)) {
+	defer wg.Done()
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if s.closing.Load() {
+				logrus.Debugf("[server] Listener %d closed", listenerID)
+				return
 			}
-			go s.handleConnection(conn)
+			logrus.Warnf("Accept error on listener %d: %v; retrying...", listenerID, err)
+			time.Sleep(5 * time.Millisecond)
+			continue
 		}
+		s.connWG.Add(1)
+		dispatch(conn)
 	}
 }
 
 func (s *Server) handleConnection(clientConn *net.TCPConn) {
 
 	s.handler.stats.AddActiveConnections(1)
+	s.trackConn(clientConn, true)
 	defer func() {
 		s.handler.stats.AddActiveConnections(^uint64(0)) // 减 1
+		s.trackConn(clientConn, false)
 		clientConn.Close()
+		s.connWG.Done()
 	}()
 
 	originalDst, err := getOriginalDst(clientConn)
@@ -107,25 +241,32 @@ func (s *Server) handleConnection(clientConn *net.TCPConn) {
 		logrus.Debugf("[server] Failed to connect to %s: %v", destAddrPort, err)
 		return
 	}
-	defer serverConn.Close()
+	s.trackConn(serverConn, true)
+	defer func() {
+		s.trackConn(serverConn, false)
+		serverConn.Close()
+	}()
 
 	clientIOConn := net.Conn(clientConn)
 	serverIOConn := serverConn
 
 	// 双向转发数据
 	done := make(chan struct{}, 2)
+	// 按顺序配对请求与响应，用于判断隧道是否建立以及自动学习白名单；
+	// 未开启 -learn-whitelist 时只有 Upgrade / CONNECT 请求需要配对，其余请求使响应方向改为原样转发
+	tracker := &responseTracker{}
 
 	// 客户端 -> 服务器 (调用 handler 修改 UA)
 	go func() {
 		defer serverConn.(*net.TCPConn).CloseWrite()
-		s.handler.ModifyAndForward(serverIOConn, clientIOConn, destAddrPort, originalDst.IP.String(), originalDst.Port)
+		s.handler.ModifyAndForward(serverIOConn, clientIOConn, destAddrPort, originalDst.IP.String(), originalDst.Port, tracker)
 		done <- struct{}{}
 	}()
 
-	// 服务器 -> 客户端 (直接转发)
+	// 服务器 -> 客户端 (需要配对时逐个解析响应头，其余数据直接转发，优先 splice)
 	go func() {
 		defer clientConn.CloseWrite()
-		io.Copy(clientIOConn, serverIOConn)
+		s.handler.RelayResponses(clientIOConn, serverIOConn, tracker)
 		done <- struct{}{}
 	}()
 
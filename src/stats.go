@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,16 +14,52 @@ import (
 
 // Stats 封装了所有统计计数器
 type Stats struct {
-	ActiveConnections atomic.Uint64 // 当前活跃连接数
-	HttpRequests      atomic.Uint64 // 已处理 HTTP 请求总数
-	ModifiedRequests  atomic.Uint64 // 成功篡改总数
-	CacheHits         atomic.Uint64 // 缓存命中(修改)
-	CacheHitNoModify  atomic.Uint64 // 缓存命中(放行)
+	ActiveConnections    atomic.Uint64 // 当前活跃连接数
+	HttpRequests         atomic.Uint64 // 已处理 HTTP 请求总数
+	ModifiedRequests     atomic.Uint64 // 成功篡改总数
+	CacheHits            atomic.Uint64 // 缓存命中(修改)
+	CacheHitNoModify     atomic.Uint64 // 缓存命中(放行)
+	TlsConnections       atomic.Uint64 // TLS 连接数
+	DeepScanHits         atomic.Uint64 // 深度扫描发现的 UA 行
+	RegexTimeouts        atomic.Uint64 // 正则匹配超时 (regexp2)
+	HttpFallbackRewrites atomic.Uint64 // 解析失败后宽松改写
+	HttpFallbackRaw      atomic.Uint64 // 解析失败后原样转发
+	AuditModified        atomic.Uint64 // 审计模式下本应修改的请求
+	AuditDrops           atomic.Uint64 // 审计模式下本应断开的连接
+
+	TlsServerNames *CounterMap // 按 SNI 统计的 TLS 连接
+	Protocols      *CounterMap // 按协议统计的连接
+	Rules          *CounterMap // 按规则统计的命中次数
+	UAOS           *CounterMap // 按系统统计的请求 (-ua-stats)
+	UADevices      *CounterMap // 按设备类型统计的请求 (-ua-stats)
+	UABrowsers     *CounterMap // 按浏览器统计的请求 (-ua-stats)
+
+	pools   atomic.Pointer[[]*WorkerPool]      // 协程池模式下的指标来源
+	learned atomic.Pointer[learnedWhitelist]   // 自动学习的白名单
+	fw      atomic.Pointer[FirewallSetManager] // 审计模式下空跑的卸载数来源
+
+	// 统计文件写入状态；速率只在写入统计文件时按周期计算，控制接口读取不影响计算窗口
+	writerMu         sync.Mutex
+	filePath         string
+	writerStop       chan struct{}
+	lastHttpRequests uint64
+	lastPool         PoolMetrics
+	lastCheckTime    time.Time
+	rps              float64 // 最近一个周期的请求速率
+	poolWaitAvgMs    float64 // 最近一个周期出队连接的平均排队时间
 }
 
 // NewStats 创建一个新的 Stats 实例
 func NewStats() *Stats {
-	return &Stats{}
+	return &Stats{
+		TlsServerNames: NewCounterMap(1000),
+		Protocols:      NewCounterMap(32),
+		Rules:          NewCounterMap(256),
+		UAOS:           NewCounterMap(32),
+		UADevices:      NewCounterMap(16),
+		UABrowsers:     NewCounterMap(32),
+		lastCheckTime:  time.Now(),
+	}
 }
 
 func (s *Stats) AddActiveConnections(val uint64) {
@@ -43,81 +82,319 @@ func (s *Stats) IncCacheHitNoModify() {
 	s.CacheHitNoModify.Add(1)
 }
 
-func (s *Stats) StartWriter(filePath string, interval time.Duration) {
-	ticker := time.NewTicker(interval)
+func (s *Stats) IncTlsConnections(serverName string) {
+	s.TlsConnections.Add(1)
+	if serverName == "" {
+		serverName = "(none)"
+	}
+	s.TlsServerNames.Inc(serverName)
+}
+
+func (s *Stats) IncDeepScanHits() {
+	s.DeepScanHits.Add(1)
+}
+
+func (s *Stats) IncRegexTimeouts() {
+	s.RegexTimeouts.Add(1)
+}
+
+func (s *Stats) IncHttpFallbackRewrites() {
+	s.HttpFallbackRewrites.Add(1)
+}
+
+func (s *Stats) IncHttpFallbackRaw() {
+	s.HttpFallbackRaw.Add(1)
+}
+
+func (s *Stats) IncAuditModified() {
+	s.AuditModified.Add(1)
+}
+
+func (s *Stats) IncAuditDrops() {
+	s.AuditDrops.Add(1)
+}
 
-	var lastHttpRequests uint64
-	lastCheckTime := time.Now()
+func (s *Stats) IncProtocol(proto Protocol) {
+	s.Protocols.Inc(string(proto))
+}
 
+func (s *Stats) IncRule(name string) {
+	s.Rules.Inc(name)
+}
+
+func (s *Stats) IncUAInfo(info uaInfo) {
+	s.UAOS.Inc(info.OS)
+	s.UADevices.Inc(info.Device)
+	s.UABrowsers.Inc(info.Browser)
+}
+
+// SetPoolSource 设置协程池指标来源，多个池 (分片模式) 的指标会合并输出
+func (s *Stats) SetPoolSource(pools ...*WorkerPool) {
+	s.pools.Store(&pools)
+}
+
+// SetLearnedSource 设置自动学习白名单，条目以 learned.<host>:<剩余秒数> 输出
+func (s *Stats) SetLearnedSource(l *learnedWhitelist) {
+	s.learned.Store(l)
+}
+
+// SetFirewallSource 设置防火墙管理器，用于输出审计模式下本应卸载的数量
+func (s *Stats) SetFirewallSource(m *FirewallSetManager) {
+	s.fw.Store(m)
+}
+
+// poolMetrics 汇总所有协程池的指标，未启用协程池时返回 false
+func (s *Stats) poolMetrics() (PoolMetrics, bool) {
+	var total PoolMetrics
+	pools := s.pools.Load()
+	if pools == nil || len(*pools) == 0 {
+		return total, false
+	}
+	for _, p := range *pools {
+		m := p.Metrics()
+		total.Workers += m.Workers
+		total.Busy += m.Busy
+		total.Queued += m.Queued
+		total.WaitTotal += m.WaitTotal
+		total.WaitCount += m.WaitCount
+		total.Overflow += m.Overflow
+		total.Rejected += m.Rejected
+	}
+	return total, true
+}
+
+func (s *Stats) StartWriter(filePath string, interval time.Duration) {
+	stop := make(chan struct{})
+	s.writerMu.Lock()
+	s.filePath = filePath
+	s.writerStop = stop
+	s.writerMu.Unlock()
+
+	ticker := time.NewTicker(interval)
 	go func() {
 		defer ticker.Stop()
-		for range ticker.C {
-			activeConn := s.ActiveConnections.Load()
-			httpRequests := s.HttpRequests.Load()
-			modified := s.ModifiedRequests.Load()
-			cacheHitModify := s.CacheHits.Load()
-			cacheHitPass := s.CacheHitNoModify.Load()
-
-			// --- 2. 计算派生指标 ---
-
-			// 处理速率 (RPS)
-			now := time.Now()
-			intervalSeconds := now.Sub(lastCheckTime).Seconds()
-			var rps float64
-			if intervalSeconds > 0 {
-				requestsSinceLast := httpRequests - lastHttpRequests
-				rps = float64(requestsSinceLast) / intervalSeconds
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.WriteSnapshot(); err != nil {
+					logrus.Warnf("Failed to write stats file: %v", err)
+				}
+			case <-stop:
+				return
 			}
-			// 更新下次计算所需的状态
-			lastHttpRequests = httpRequests
-			lastCheckTime = now
+		}
+	}()
+}
 
-			// 总缓存命中 = 缓存命中(修改) + 缓存命中(放行)
-			totalCacheHits := cacheHitModify + cacheHitPass
+// StopWriter 停止定时写入统计文件 (平滑升级后由新进程接管)
+func (s *Stats) StopWriter() {
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+	if s.writerStop != nil {
+		close(s.writerStop)
+		s.writerStop = nil
+	}
+	s.filePath = ""
+}
 
-			// 规则处理 = 请求总数 - 总缓存命中
-			var ruleProcessing uint64
-			if httpRequests > totalCacheHits {
-				ruleProcessing = httpRequests - totalCacheHits
-			}
+// WriteSnapshot 立即将当前统计写入统计文件 (退出前也会调用一次)
+func (s *Stats) WriteSnapshot() error {
+	s.updateRates()
+	content := s.Render()
+	s.writerMu.Lock()
+	filePath := s.filePath
+	s.writerMu.Unlock()
+	if filePath == "" {
+		return nil
+	}
+	return os.WriteFile(filePath, []byte(content), 0644)
+}
 
-			// 直接放行 = 请求总数 - 成功修改
-			var directPass uint64
-			if httpRequests > modified {
-				directPass = httpRequests - modified
-			}
+// updateRates 计算自上次写入统计文件以来的请求速率与平均排队时间
+func (s *Stats) updateRates() {
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
 
-			// 总缓存率 = 总缓存命中 / 请求总数 * 100%
-			var totalCacheRatio float64
-			if httpRequests > 0 {
-				totalCacheRatio = (float64(totalCacheHits) * 100) / float64(httpRequests)
-			}
+	httpRequests := s.HttpRequests.Load()
+	now := time.Now()
+	s.rps = 0
+	if intervalSeconds := now.Sub(s.lastCheckTime).Seconds(); intervalSeconds > 0 {
+		s.rps = float64(httpRequests-s.lastHttpRequests) / intervalSeconds
+	}
+	s.lastHttpRequests = httpRequests
+	s.lastCheckTime = now
 
-			content := fmt.Sprintf(
-				"current_connections:%d\n"+
-					"total_requests:%d\n"+
-					"rps:%.2f\n"+
-					"successful_modifications:%d\n"+
-					"direct_passthrough:%d\n"+
-					"rule_processing:%d\n"+
-					"cache_hit_modify:%d\n"+
-					"cache_hit_pass:%d\n"+
-					"total_cache_ratio:%.2f\n",
-				activeConn,
-				httpRequests,
-				rps,
-				modified,
-				directPass,
-				ruleProcessing,
-				cacheHitModify,
-				cacheHitPass,
-				totalCacheRatio,
-			)
-
-			err := os.WriteFile(filePath, []byte(content), 0644)
-			if err != nil {
-				logrus.Warnf("Failed to write stats file: %v", err)
-			}
+	if pool, ok := s.poolMetrics(); ok {
+		s.poolWaitAvgMs = 0
+		if n := pool.WaitCount - s.lastPool.WaitCount; n > 0 {
+			s.poolWaitAvgMs = float64(pool.WaitTotal-s.lastPool.WaitTotal) / float64(time.Millisecond) / float64(n)
 		}
-	}()
+		s.lastPool = pool
+	}
+}
+
+// Render 生成统计文本 (key:value 每行一项)，统计文件与控制接口共用
+// 只读取计数器，rps 与 pool_wait_avg_ms 是最近一次写入统计文件时计算的值
+func (s *Stats) Render() string {
+	s.writerMu.Lock()
+	rps, waitAvgMs := s.rps, s.poolWaitAvgMs
+	s.writerMu.Unlock()
+
+	activeConn := s.ActiveConnections.Load()
+	httpRequests := s.HttpRequests.Load()
+	modified := s.ModifiedRequests.Load()
+	cacheHitModify := s.CacheHits.Load()
+	cacheHitPass := s.CacheHitNoModify.Load()
+	tlsConnections := s.TlsConnections.Load()
+	deepScanHits := s.DeepScanHits.Load()
+	regexTimeouts := s.RegexTimeouts.Load()
+	fallbackRewrites := s.HttpFallbackRewrites.Load()
+	fallbackRaw := s.HttpFallbackRaw.Load()
+
+	// --- 2. 计算派生指标 ---
+
+	// 总缓存命中 = 缓存命中(修改) + 缓存命中(放行)
+	totalCacheHits := cacheHitModify + cacheHitPass
+
+	// 规则处理 = 请求总数 - 总缓存命中
+	var ruleProcessing uint64
+	if httpRequests > totalCacheHits {
+		ruleProcessing = httpRequests - totalCacheHits
+	}
+
+	// 直接放行 = 请求总数 - 成功修改
+	var directPass uint64
+	if httpRequests > modified {
+		directPass = httpRequests - modified
+	}
+
+	// 总缓存率 = 总缓存命中 / 请求总数 * 100%
+	var totalCacheRatio float64
+	if httpRequests > 0 {
+		totalCacheRatio = (float64(totalCacheHits) * 100) / float64(httpRequests)
+	}
+
+	content := fmt.Sprintf(
+		"current_connections:%d\n"+
+			"total_requests:%d\n"+
+			"rps:%.2f\n"+
+			"successful_modifications:%d\n"+
+			"direct_passthrough:%d\n"+
+			"rule_processing:%d\n"+
+			"cache_hit_modify:%d\n"+
+			"cache_hit_pass:%d\n"+
+			"total_cache_ratio:%.2f\n"+
+			"tls_connections:%d\n"+
+			"deep_scan_hits:%d\n"+
+			"regex_timeouts:%d\n"+
+			"http_fallback_rewrite:%d\n"+
+			"http_fallback_raw:%d\n",
+		activeConn,
+		httpRequests,
+		rps,
+		modified,
+		directPass,
+		ruleProcessing,
+		cacheHitModify,
+		cacheHitPass,
+		totalCacheRatio,
+		tlsConnections,
+		deepScanHits,
+		regexTimeouts,
+		fallbackRewrites,
+		fallbackRaw,
+	)
+	if pool, ok := s.poolMetrics(); ok {
+		content += fmt.Sprintf(
+			"pool_workers:%d\n"+
+				"pool_busy:%d\n"+
+				"pool_queue:%d\n"+
+				"pool_wait_avg_ms:%.2f\n"+
+				"pool_overflow:%d\n"+
+				"pool_rejected:%d\n",
+			pool.Workers,
+			pool.Busy,
+			pool.Queued,
+			waitAvgMs,
+			pool.Overflow,
+			pool.Rejected,
+		)
+	}
+	content += s.Rules.Format("rule", 0)
+	auditOffloads := s.fw.Load().DryRunOffloads()
+	if auditModified, auditDrops := s.AuditModified.Load(), s.AuditDrops.Load(); auditModified+auditDrops+auditOffloads > 0 {
+		content += fmt.Sprintf("audit_would_modify:%d\naudit_would_drop:%d\naudit_would_offload:%d\n", auditModified, auditDrops, auditOffloads)
+	}
+	learned := s.learned.Load().Entries()
+	content += fmt.Sprintf("learned_hosts:%d\n", len(learned))
+	for _, e := range learned {
+		content += fmt.Sprintf("learned.%s:%d\n", e.Host, int(time.Until(e.Expires).Seconds()))
+	}
+	content += s.UAOS.Format("ua_os", 0)
+	content += s.UADevices.Format("ua_device", 0)
+	content += s.UABrowsers.Format("ua_browser", 0)
+	content += s.Protocols.Format("proto", 0)
+	content += s.TlsServerNames.Format("tls_sni", 10)
+
+	return content
+}
+
+// CounterMap 是按标签分组的计数器，标签数量有上限以限制内存占用
+type CounterMap struct {
+	mu        sync.Mutex
+	counts    map[string]uint64
+	maxLabels int
+}
+
+func NewCounterMap(maxLabels int) *CounterMap {
+	return &CounterMap{
+		counts:    make(map[string]uint64),
+		maxLabels: maxLabels,
+	}
+}
+
+// Inc 计数加 1，超出标签上限的新标签计入 "(other)"
+func (c *CounterMap) Inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[label]; !ok && len(c.counts) >= c.maxLabels {
+		label = "(other)"
+	}
+	c.counts[label]++
+}
+
+// LabelCount 是一个标签及其计数
+type LabelCount struct {
+	Label string
+	Count uint64
+}
+
+// Top 返回计数最高的 n 个标签 (n <= 0 表示全部)
+func (c *CounterMap) Top(n int) []LabelCount {
+	c.mu.Lock()
+	items := make([]LabelCount, 0, len(c.counts))
+	for label, count := range c.counts {
+		items = append(items, LabelCount{Label: label, Count: count})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Label < items[j].Label
+	})
+	if n > 0 && len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+// Format 以 "<prefix>.<label>:<count>" 的形式输出计数最高的 n 项
+func (c *CounterMap) Format(prefix string, n int) string {
+	var b strings.Builder
+	for _, item := range c.Top(n) {
+		fmt.Fprintf(&b, "%s.%s:%d\n", prefix, item.Label, item.Count)
+	}
+	return b.String()
 }
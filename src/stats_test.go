@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderDoesNotResetRates(t *testing.T) {
+	s := NewStats()
+	s.HttpRequests.Add(50)
+	time.Sleep(10 * time.Millisecond)
+	s.updateRates()
+
+	rpsLine := func(content string) string {
+		for _, line := range strings.Split(content, "\n") {
+			if strings.HasPrefix(line, "rps:") {
+				return line
+			}
+		}
+		return ""
+	}
+	first := rpsLine(s.Render())
+	if first == "" || first == "rps:0.00" {
+		t.Fatalf("rps not computed: %q", first)
+	}
+	// 控制接口读取不应影响统计文件的计算窗口
+	s.Render()
+	if got := rpsLine(s.Render()); got != first {
+		t.Errorf("rps changed by Render: %q, want %q", got, first)
+	}
+	s.HttpRequests.Add(50)
+	s.Render()
+	s.updateRates()
+	if got := rpsLine(s.Render()); got == "rps:0.00" {
+		t.Error("requests counted between writes were lost")
+	}
+}
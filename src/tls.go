@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	tlsRecordHeaderLen      = 5
+	tlsRecordTypeHandshake  = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtServerName        = 0x0000
+	tlsExtALPN              = 0x0010
+)
+
+var (
+	errNotClientHello = errors.New("not a TLS ClientHello")
+	errTLSTruncated   = errors.New("TLS ClientHello truncated")
+)
+
+// tlsClientHello 保存从 ClientHello 中解析出的关键信息
+type tlsClientHello struct {
+	ServerName string   // SNI
+	ALPN       []string // ALPN 协议列表
+}
+
+// looksLikeTLS 判断首字节是否为 TLS 握手记录
+func looksLikeTLS(hint []byte) bool {
+	return len(hint) >= 3 && hint[0] == tlsRecordTypeHandshake && hint[1] == 0x03 && hint[2] <= 0x04
+}
+
+// peekClientHello 在不消费数据的前提下，从 reader 缓冲区中解析 ClientHello
+// 记录超过缓冲区大小时只解析已缓冲的部分，只要拿到 SNI 即视为成功
+func peekClientHello(reader *bufio.Reader) (*tlsClientHello, error) {
+	header, err := reader.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if !looksLikeTLS(header) {
+		return nil, errNotClientHello
+	}
+
+	need := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(header[3:5]))
+	if need > reader.Size() {
+		need = reader.Size()
+	}
+	data, err := reader.Peek(need)
+	if err != nil && len(data) == 0 {
+		return nil, err
+	}
+
+	hello, err := parseClientHello(data)
+	if err == errTLSTruncated && hello != nil && hello.ServerName != "" {
+		return hello, nil
+	}
+	return hello, err
+}
+
+// parseClientHello 解析一条 TLS 握手记录中的 ClientHello
+// 数据短于记录头声明的长度时返回已解析出的部分以及 errTLSTruncated
+func parseClientHello(data []byte) (*tlsClientHello, error) {
+	if len(data) < tlsRecordHeaderLen || !looksLikeTLS(data) {
+		return nil, errNotClientHello
+	}
+	r := tlsReader(data[tlsRecordHeaderLen:])
+	recordTruncated := false
+	if recordLen := int(binary.BigEndian.Uint16(data[3:5])); len(r) >= recordLen {
+		r = r[:recordLen]
+	} else {
+		recordTruncated = true
+	}
+
+	msgType, ok := r.u8()
+	if !ok {
+		return nil, errTLSTruncated
+	}
+	if msgType != tlsHandshakeClientHello {
+		return nil, errNotClientHello
+	}
+	// handshake length(3) + client_version(2) + random(32)
+	if !r.skip(3 + 2 + 32) {
+		return nil, errTLSTruncated
+	}
+	// session_id
+	if _, ok := r.vec8(); !ok {
+		return nil, errTLSTruncated
+	}
+	// cipher_suites
+	if _, ok := r.vec16(); !ok {
+		return nil, errTLSTruncated
+	}
+	// compression_methods
+	if _, ok := r.vec8(); !ok {
+		return nil, errTLSTruncated
+	}
+
+	hello := &tlsClientHello{}
+	if len(r) == 0 {
+		if recordTruncated {
+			return hello, errTLSTruncated
+		}
+		// 没有扩展字段
+		return hello, nil
+	}
+	extLen, ok := r.u16()
+	if !ok {
+		return hello, errTLSTruncated
+	}
+	exts := r
+	truncated := false
+	if int(extLen) <= len(exts) {
+		exts = exts[:extLen]
+	} else {
+		truncated = true
+	}
+
+	for len(exts) > 0 {
+		extType, ok1 := exts.u16()
+		body, ok2 := exts.vec16()
+		if !ok1 || !ok2 {
+			return hello, errTLSTruncated
+		}
+		switch extType {
+		case tlsExtServerName:
+			hello.ServerName = parseSNIExtension(body)
+		case tlsExtALPN:
+			hello.ALPN = parseALPNExtension(body)
+		}
+	}
+	if truncated || recordTruncated {
+		return hello, errTLSTruncated
+	}
+	return hello, nil
+}
+
+// parseSNIExtension 返回 server_name 扩展中的第一个 host_name
+func parseSNIExtension(body tlsReader) string {
+	list, ok := body.vec16()
+	if !ok {
+		return ""
+	}
+	for len(list) > 0 {
+		nameType, ok1 := list.u8()
+		name, ok2 := list.vec16()
+		if !ok1 || !ok2 {
+			return ""
+		}
+		if nameType == 0 {
+			return strings.ToLower(strings.TrimSuffix(string(name), "."))
+		}
+	}
+	return ""
+}
+
+func parseALPNExtension(body tlsReader) []string {
+	list, ok := body.vec16()
+	if !ok {
+		return nil
+	}
+	var protos []string
+	for len(list) > 0 {
+		proto, ok := list.vec8()
+		if !ok {
+			break
+		}
+		protos = append(protos, string(proto))
+	}
+	return protos
+}
+
+// matchDomainSuffix 判断 host 是否命中域名规则
+// "example.com" 匹配自身及所有子域名，"*.example.com" 仅匹配子域名
+func matchDomainSuffix(host, pattern string) bool {
+	if host == "" || pattern == "" {
+		return false
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// tlsReader 是一个简单的字节切片游标
+type tlsReader []byte
+
+func (r *tlsReader) u8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) bytes(n int) (tlsReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *tlsReader) vec8() (tlsReader, bool) {
+	n, ok := r.u8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func (r *tlsReader) vec16() (tlsReader, bool) {
+	n, ok := r.u16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
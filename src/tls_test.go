@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func u16(n int) []byte { return []byte{byte(n >> 8), byte(n)} }
+
+func tlsExtension(extType int, body []byte) []byte {
+	return append(append(u16(extType), u16(len(body))...), body...)
+}
+
+func sniExtension(name string) []byte {
+	entry := append(append([]byte{0}, u16(len(name))...), name...)
+	return tlsExtension(tlsExtServerName, append(u16(len(entry)), entry...))
+}
+
+func alpnExtension(protos ...string) []byte {
+	var list []byte
+	for _, p := range protos {
+		list = append(append(list, byte(len(p))), p...)
+	}
+	return tlsExtension(tlsExtALPN, append(u16(len(list)), list...))
+}
+
+// buildClientHello 构造一条 ClientHello 记录，exts 为 nil 时不带扩展字段
+func buildClientHello(exts []byte) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session_id
+	body = append(body, 0, 2, 0x13, 0x01)    // cipher_suites
+	body = append(body, 1, 0)                // compression_methods
+	if exts != nil {
+		body = append(append(body, u16(len(exts))...), exts...)
+	}
+	hs := append([]byte{tlsHandshakeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{tlsRecordTypeHandshake, 0x03, 0x01, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+// realClientHello 返回 crypto/tls 客户端发送的第一条记录
+func realClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReaderSize(server, 64*1024)
+	header, err := reader.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := reader.Peek(tlsRecordHeaderLen + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), record...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	exts := append(sniExtension("Example.COM."), alpnExtension("h2", "http/1.1")...)
+	badSNI := tlsExtension(tlsExtServerName, []byte{0, 9, 0, 0, 3, 'a'}) // 列表长度超出扩展
+	tests := []struct {
+		name    string
+		data    []byte
+		want    *tlsClientHello
+		wantErr error
+	}{
+		{"sni and alpn", buildClientHello(exts), &tlsClientHello{ServerName: "example.com", ALPN: []string{"h2", "http/1.1"}}, nil},
+		{"no extensions", buildClientHello(nil), &tlsClientHello{}, nil},
+		{"unknown extension first", buildClientHello(append(tlsExtension(0x002b, []byte{2, 3, 4}), sniExtension("a.test")...)), &tlsClientHello{ServerName: "a.test"}, nil},
+		{"bad sni list length", buildClientHello(badSNI), &tlsClientHello{}, nil},
+		{"extension length beyond record", buildClientHello(append(sniExtension("a.test"), 0, 0x10, 0, 0xff)), &tlsClientHello{ServerName: "a.test"}, errTLSTruncated},
+		{"not handshake", append([]byte{0x17}, buildClientHello(nil)[1:]...), nil, errNotClientHello},
+		{"server hello", func() []byte { b := buildClientHello(nil); b[5] = 0x02; return b }(), nil, errNotClientHello},
+		{"short record", []byte{0x16, 0x03, 0x01}, nil, errNotClientHello},
+		{"header only", []byte{0x16, 0x03, 0x01, 0x00, 0x10}, nil, errTLSTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseClientHello(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	data := buildClientHello(append(sniExtension("example.com"), alpnExtension("h2")...))
+	// 任意位置截断都不能越界，只能返回截断错误 (SNI 完整时带上已解析的部分)
+	for n := tlsRecordHeaderLen; n < len(data); n++ {
+		hello, err := parseClientHello(data[:n])
+		if err != errTLSTruncated {
+			t.Fatalf("truncated at %d: error = %v, want %v", n, err, errTLSTruncated)
+		}
+		if hello != nil && hello.ServerName != "" && hello.ServerName != "example.com" {
+			t.Fatalf("truncated at %d: partial SNI %q", n, hello.ServerName)
+		}
+	}
+}
+
+func TestParseClientHelloFromCryptoTLS(t *testing.T) {
+	data := realClientHello(t, &tls.Config{ServerName: "www.example.org", NextProtos: []string{"h2", "http/1.1"}})
+	hello, err := parseClientHello(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "www.example.org" || !reflect.DeepEqual(hello.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("got %+v", hello)
+	}
+}
+
+func TestPeekClientHelloLargerThanBuffer(t *testing.T) {
+	// 记录超过缓冲区，但 SNI 位于已缓冲的部分
+	padding := tlsExtension(0x0015, make([]byte, 512))
+	data := buildClientHello(append(sniExtension("a.test"), padding...))
+	reader := bufio.NewReaderSize(bytes.NewReader(data), 128)
+	hello, err := peekClientHello(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "a.test" {
+		t.Errorf("ServerName = %q", hello.ServerName)
+	}
+	if reader.Buffered() == 0 {
+		t.Error("peekClientHello consumed data")
+	}
+
+	// 缓冲区中没有 SNI
+	data = buildClientHello(append(padding, sniExtension("a.test")...))
+	if _, err := peekClientHello(bufio.NewReaderSize(bytes.NewReader(data), 128)); err != errTLSTruncated {
+		t.Errorf("error = %v, want %v", err, errTLSTruncated)
+	}
+}
+
+func TestMatchDomainSuffix(t *testing.T) {
+	tests := []struct {
+		host, pattern string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "example.com", true},
+		{"badexample.com", "example.com", false},
+		{"example.com", "*.example.com", false},
+		{"a.b.example.com", "*.example.com", true},
+		{"", "example.com", false},
+		{"example.com", "", false},
+	}
+	for _, tt := range tests {
+		if got := matchDomainSuffix(tt.host, tt.pattern); got != tt.want {
+			t.Errorf("matchDomainSuffix(%q, %q) = %v, want %v", tt.host, tt.pattern, got, tt.want)
+		}
+	}
+}
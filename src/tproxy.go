@@ -14,14 +14,12 @@ import (
 
 // getOriginalDst 获取被 REDIRECT 规则重定向前的原始目标地址
 // 使用 SO_ORIGINAL_DST socket 选项，这是 iptables REDIRECT 目标填充的
+// 通过 SyscallConn().Control 直接在原 fd 上调用 getsockopt，避免 conn.File() 复制 fd 并切换为阻塞模式
 func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
-	file, err := conn.File()
+	rawConn, err := conn.SyscallConn()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file descriptor: %w", err)
+		return nil, fmt.Errorf("failed to get raw connection: %w", err)
 	}
-	defer file.Close()
-
-	fd := int(file.Fd())
 
 	// SO_ORIGINAL_DST = 80
 	const SO_ORIGINAL_DST = 80
@@ -29,17 +27,22 @@ func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
 	// 使用 sockaddr 结构获取原始目标地址
 	var addr unix.RawSockaddrInet4
 	addrLen := uint32(unsafe.Sizeof(addr))
-
-	_, _, errno := unix.Syscall6(
-		unix.SYS_GETSOCKOPT,
-		uintptr(fd),
-		uintptr(unix.SOL_IP),
-		uintptr(SO_ORIGINAL_DST),
-		uintptr(unsafe.Pointer(&addr)),
-		uintptr(unsafe.Pointer(&addrLen)),
-		0,
-	)
-
+	var errno unix.Errno
+
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(
+			unix.SYS_GETSOCKOPT,
+			fd,
+			uintptr(unix.SOL_IP),
+			uintptr(SO_ORIGINAL_DST),
+			uintptr(unsafe.Pointer(&addr)),
+			uintptr(unsafe.Pointer(&addrLen)),
+			0,
+		)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access file descriptor: %w", err)
+	}
 	if errno != 0 {
 		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST failed: %v", errno)
 	}
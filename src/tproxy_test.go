@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// getOriginalDstViaFile 是改用 SyscallConn 之前的实现：通过 conn.File() 复制 fd 后调用 getsockopt
+func getOriginalDstViaFile(conn *net.TCPConn) error {
+	file, err := conn.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var addr unix.RawSockaddrInet4
+	addrLen := uint32(unsafe.Sizeof(addr))
+	_, _, errno := unix.Syscall6(
+		unix.SYS_GETSOCKOPT,
+		file.Fd(),
+		uintptr(unix.SOL_IP),
+		80, // SO_ORIGINAL_DST
+		uintptr(unsafe.Pointer(&addr)),
+		uintptr(unsafe.Pointer(&addrLen)),
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// BenchmarkGetOriginalDst 比较每个新连接获取原始目标地址的开销
+// 本地连接没有经过 REDIRECT，getsockopt 返回 ENOENT，但 fd 复制与系统调用的开销相同
+func BenchmarkGetOriginalDst(b *testing.B) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer accepted.Close()
+	conn := accepted.(*net.TCPConn)
+
+	b.Run("SyscallConn", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			getOriginalDst(conn)
+		}
+	})
+	b.Run("File", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			getOriginalDstViaFile(conn)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+)
+
+// uaInfo 是内置解析器从 User-Agent 中提取的结构化信息，无法识别的字段为 "Other" / 空
+type uaInfo struct {
+	OS             string // iOS, Android, HarmonyOS, Windows, WindowsPhone, macOS, ChromeOS, Linux, PlayStation, Xbox, Nintendo, Other
+	OSVersion      string // 以 . 分隔，如 17.1、10.0
+	Device         string // mobile, tablet, desktop, tv, console, bot, other
+	Browser        string // Edge, Opera, SamsungBrowser, WeChat, UCBrowser, Firefox, Chrome, Safari, curl, Wget, Other
+	BrowserVersion string
+	Engine         string // Blink, WebKit, Gecko, Trident, Other
+}
+
+// 操作系统规则，按顺序匹配 (Windows Phone 需先于 Windows，Android 需先于 Linux)
+var uaOSRules = []struct {
+	family  string
+	token   string // UA 中出现的标记
+	version string // 版本号前缀，为空时不提取版本
+}{
+	{"WindowsPhone", "Windows Phone", "Windows Phone "},
+	{"Xbox", "Xbox", ""},
+	{"PlayStation", "PlayStation", "PlayStation "},
+	{"Nintendo", "Nintendo", ""},
+	{"HarmonyOS", "OpenHarmony", "OpenHarmony "},
+	{"HarmonyOS", "HarmonyOS", "HarmonyOS "},
+	{"iOS", "iPhone", " OS "},
+	{"iOS", "iPad", " OS "},
+	{"iOS", "iPod", " OS "},
+	{"Android", "Android", "Android "},
+	{"Windows", "Windows", "Windows NT "},
+	{"ChromeOS", "CrOS", ""},
+	{"macOS", "Macintosh", "Mac OS X "},
+	{"Linux", "Linux", ""},
+}
+
+// 浏览器规则，按顺序匹配 (基于 Chromium 的浏览器需先于 Chrome)
+var uaBrowserRules = []struct {
+	name   string
+	tokens []string // 任一标记后紧跟版本号
+}{
+	{"Edge", []string{"Edg/", "EdgA/", "EdgiOS/", "Edge/"}},
+	{"Opera", []string{"OPR/", "Opera/"}},
+	{"SamsungBrowser", []string{"SamsungBrowser/"}},
+	{"WeChat", []string{"MicroMessenger/"}},
+	{"UCBrowser", []string{"UCBrowser/"}},
+	{"Firefox", []string{"Firefox/", "FxiOS/"}},
+	{"Chrome", []string{"Chrome/", "CriOS/"}},
+	{"Safari", []string{"Version/"}},
+	{"curl", []string{"curl/"}},
+	{"Wget", []string{"Wget/"}},
+}
+
+var uaBotTokens = []string{"bot", "Bot", "spider", "Spider", "crawler", "Crawler", "curl/", "Wget/", "python-requests", "Go-http-client"}
+
+var uaTVTokens = []string{"SmartTV", "SMART-TV", "Android TV", "AndroidTV", "AppleTV", "BRAVIA", "Tizen TV", "HbbTV", "GoogleTV"}
+
+// parseUA 解析 User-Agent
+func parseUA(ua string) uaInfo {
+	info := uaInfo{OS: "Other", Device: "other", Browser: "Other", Engine: "Other"}
+
+	for _, r := range uaOSRules {
+		if !strings.Contains(ua, r.token) {
+			continue
+		}
+		info.OS = r.family
+		if r.version != "" {
+			info.OSVersion = versionAfter(ua, r.version, true)
+		}
+		break
+	}
+
+	for _, r := range uaBrowserRules {
+		for _, token := range r.tokens {
+			if strings.Contains(ua, token) {
+				info.Browser = r.name
+				info.BrowserVersion = versionAfter(ua, token, false)
+				break
+			}
+		}
+		if info.Browser != "Other" {
+			break
+		}
+	}
+	// Version/ 只在 Safari 中出现时才算 Safari
+	if info.Browser == "Safari" && !strings.Contains(ua, "Safari/") {
+		info.Browser, info.BrowserVersion = "Other", ""
+	}
+
+	switch {
+	case strings.Contains(ua, "Trident/") || strings.Contains(ua, "MSIE "):
+		info.Engine = "Trident"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "Chromium/") || strings.Contains(ua, "Edg/"):
+		info.Engine = "Blink"
+	case strings.Contains(ua, "AppleWebKit/"):
+		info.Engine = "WebKit"
+	case strings.Contains(ua, "Gecko/") || strings.Contains(ua, "Firefox/"):
+		info.Engine = "Gecko"
+	}
+
+	info.Device = uaDeviceClass(ua, info.OS)
+	return info
+}
+
+// uaDeviceClass 判断设备类型
+func uaDeviceClass(ua string, os string) string {
+	for _, token := range uaTVTokens {
+		if strings.Contains(ua, token) {
+			return "tv"
+		}
+	}
+	switch os {
+	case "Xbox", "PlayStation", "Nintendo":
+		return "console"
+	}
+	for _, token := range uaBotTokens {
+		if strings.Contains(ua, token) {
+			return "bot"
+		}
+	}
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet"):
+		return "tablet"
+	case os == "Android" || os == "HarmonyOS":
+		// Android 平板的 UA 不带 Mobile
+		if strings.Contains(ua, "Mobile") {
+			return "mobile"
+		}
+		return "tablet"
+	case os == "iOS" || os == "WindowsPhone" || strings.Contains(ua, "Mobile"):
+		return "mobile"
+	case os == "Windows" || os == "macOS" || os == "ChromeOS" || os == "Linux":
+		return "desktop"
+	}
+	return "other"
+}
+
+// versionAfter 提取 token 之后的版本号；underscore 为 true 时把 _ 视为 . (iOS / macOS)
+func versionAfter(ua, token string, underscore bool) string {
+	i := strings.Index(ua, token)
+	if i < 0 {
+		return ""
+	}
+	rest := ua[i+len(token):]
+	end := 0
+	for end < len(rest) {
+		c := rest[end]
+		if c >= '0' && c <= '9' || c == '.' || (underscore && c == '_') {
+			end++
+			continue
+		}
+		break
+	}
+	v := strings.TrimRight(rest[:end], "._")
+	if underscore {
+		v = strings.ReplaceAll(v, "_", ".")
+	}
+	return v
+}
+
+// Field 按规则字段名返回解析结果
+func (info *uaInfo) Field(name string) string {
+	switch name {
+	case "os":
+		return info.OS
+	case "os-version":
+		return info.OSVersion
+	case "device":
+		return info.Device
+	case "browser":
+		return info.Browser
+	case "browser-version":
+		return info.BrowserVersion
+	case "engine":
+		return info.Engine
+	}
+	return ""
+}
+
+// expandUATemplate 替换 UA 模板中的 {os} {os_version} {device} {browser} {browser_version} {engine}
+// 占位符取自原始 UA 的解析结果，不含占位符的模板原样返回
+func expandUATemplate(tmpl string, ua string) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	info := parseUA(ua)
+	return strings.NewReplacer(
+		"{os}", info.OS,
+		"{os_version}", info.OSVersion,
+		"{device}", info.Device,
+		"{browser}", info.Browser,
+		"{browser_version}", info.BrowserVersion,
+		"{engine}", info.Engine,
+	).Replace(tmpl)
+}
@@ -0,0 +1,106 @@
+package main
+
+import "testing"
+
+func TestParseUA(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want uaInfo
+	}{
+		{"iPhone Safari", uaIPhone, uaInfo{"iOS", "17.1", "mobile", "Safari", "17.1", "WebKit"}},
+		{"iPad", "Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			uaInfo{"iOS", "16.6", "tablet", "Chrome", "120.0.6099.119", "WebKit"}},
+		{"Android phone", uaAndroid, uaInfo{"Android", "14", "mobile", "Chrome", "120.0.6099.43", "Blink"}},
+		{"Android tablet", "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			uaInfo{"Android", "13", "tablet", "Chrome", "120.0.0.0", "Blink"}},
+		{"Android WeChat", "Mozilla/5.0 (Linux; Android 12; V2049A) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.5304.141 Mobile Safari/537.36 MicroMessenger/8.0.43.2480(0x28002B51) WeChat/arm64",
+			uaInfo{"Android", "12", "mobile", "WeChat", "8.0.43.2480", "Blink"}},
+		{"HarmonyOS", "Mozilla/5.0 (Phone; OpenHarmony 4.1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36 ArkWeb/4.1.6.1 Mobile",
+			uaInfo{"HarmonyOS", "4.1", "mobile", "Chrome", "114.0.0.0", "Blink"}},
+		{"Windows Chrome", uaWindows, uaInfo{"Windows", "10.0", "desktop", "Chrome", "120.0.0.0", "Blink"}},
+		{"Windows Edge", uaWindows + " Edg/120.0.2210.91", uaInfo{"Windows", "10.0", "desktop", "Edge", "120.0.2210.91", "Blink"}},
+		{"Windows IE", "Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko", uaInfo{"Windows", "6.1", "desktop", "Other", "", "Trident"}},
+		{"Windows Phone", "Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Mobile Safari/537.36 Edge/15.14977",
+			uaInfo{"WindowsPhone", "10.0", "mobile", "Edge", "15.14977", "Blink"}},
+		{"macOS Safari", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+			uaInfo{"macOS", "10.15.7", "desktop", "Safari", "17.1", "WebKit"}},
+		{"Linux Firefox", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", uaInfo{"Linux", "", "desktop", "Firefox", "121.0", "Gecko"}},
+		{"ChromeOS", "Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			uaInfo{"ChromeOS", "", "desktop", "Chrome", "120.0.0.0", "Blink"}},
+		{"smart TV", "Mozilla/5.0 (SMART-TV; Linux; Tizen 6.0) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/4.0 Chrome/76.0.3809.146 TV Safari/537.36",
+			uaInfo{"Linux", "", "tv", "SamsungBrowser", "4.0", "Blink"}},
+		{"console", "Mozilla/5.0 (PlayStation 5 3.11) AppleWebKit/605.1.15 (KHTML, like Gecko)", uaInfo{"PlayStation", "5", "console", "Other", "", "WebKit"}},
+		{"Googlebot", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", uaInfo{"Other", "", "bot", "Other", "", "Other"}},
+		{"Googlebot smartphone", uaAndroid + " (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", uaInfo{"Android", "14", "bot", "Chrome", "120.0.6099.43", "Blink"}},
+		{"curl", "curl/8.4.0", uaInfo{"Other", "", "bot", "curl", "8.4.0", "Other"}},
+		{"Version without Safari", "SomeApp Version/2.0", uaInfo{"Other", "", "other", "Other", "", "Other"}},
+		{"truncated", "Mozilla/5.0 (iPhone; CPU iPhone OS", uaInfo{"iOS", "", "mobile", "Other", "", "Other"}},
+		{"empty", "", uaInfo{"Other", "", "other", "Other", "", "Other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUA(tt.ua); got != tt.want {
+				t.Errorf("parseUA(%q)\n got %+v\nwant %+v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionAfter(t *testing.T) {
+	tests := []struct {
+		ua, token  string
+		underscore bool
+		want       string
+	}{
+		{"Android 14; Pixel", "Android ", false, "14"},
+		{"CPU iPhone OS 17_1_2 like", " OS ", true, "17.1.2"},
+		{"CPU iPhone OS 17_1_2 like", " OS ", false, "17"},
+		{"Chrome/120.", "Chrome/", false, "120"},
+		{"OS 17_ like", "OS ", true, "17"},
+		{"Chrome/", "Chrome/", false, ""},
+		{"Chrome/abc", "Chrome/", false, ""},
+		{"Firefox/121.0", "Chrome/", false, ""},
+	}
+	for _, tt := range tests {
+		if got := versionAfter(tt.ua, tt.token, tt.underscore); got != tt.want {
+			t.Errorf("versionAfter(%q, %q, %v) = %q, want %q", tt.ua, tt.token, tt.underscore, got, tt.want)
+		}
+	}
+}
+
+func TestUAInfoField(t *testing.T) {
+	info := parseUA(uaIPhone)
+	for name, want := range map[string]string{
+		"os":              "iOS",
+		"os-version":      "17.1",
+		"device":          "mobile",
+		"browser":         "Safari",
+		"browser-version": "17.1",
+		"engine":          "WebKit",
+		"os_version":      "",
+		"unknown":         "",
+	} {
+		if got := info.Field(name); got != want {
+			t.Errorf("Field(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExpandUATemplate(t *testing.T) {
+	tests := []struct {
+		tmpl, ua, want string
+	}{
+		{"Masked-UA", uaIPhone, "Masked-UA"},
+		{"Mozilla/5.0 ({os} {os_version}; {device}) {browser}/{browser_version} {engine}", uaIPhone,
+			"Mozilla/5.0 (iOS 17.1; mobile) Safari/17.1 WebKit"},
+		{"{os}-{os}", uaWindows, "Windows-Windows"},
+		{"{os} {unknown} {", uaAndroid, "Android {unknown} {"},
+		{"{os}/{os_version}", "", "Other/"},
+	}
+	for _, tt := range tests {
+		if got := expandUATemplate(tt.tmpl, tt.ua); got != tt.want {
+			t.Errorf("expandUATemplate(%q, %q) = %q, want %q", tt.tmpl, tt.ua, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// uciSection 是 UCI 配置文件中的一个 section
+type uciSection struct {
+	Type    string
+	Name    string
+	Options map[string]string
+	Lists   map[string][]string
+}
+
+// uciFile 是解析后的 UCI 配置文件
+type uciFile struct {
+	Sections []*uciSection
+}
+
+// Section 返回指定名称的 section，不存在时返回空 section
+func (f *uciFile) Section(name string) *uciSection {
+	for _, s := range f.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return &uciSection{Name: name, Options: map[string]string{}, Lists: map[string][]string{}}
+}
+
+// Get 返回 option 的值；只有 list 时返回空格连接的列表 (同 config_get)
+func (s *uciSection) Get(key, def string) string {
+	if v, ok := s.Options[key]; ok {
+		return v
+	}
+	if l, ok := s.Lists[key]; ok {
+		return strings.Join(l, " ")
+	}
+	return def
+}
+
+// GetBool 按 config_get_bool 的规则解析布尔值
+func (s *uciSection) GetBool(key string, def bool) bool {
+	switch strings.ToLower(s.Get(key, "")) {
+	case "1", "on", "true", "yes", "enabled":
+		return true
+	case "0", "off", "false", "no", "disabled":
+		return false
+	}
+	return def
+}
+
+// GetInt 解析整数 option，未设置时返回 def
+func (s *uciSection) GetInt(key string, def int) (int, error) {
+	v := strings.TrimSpace(s.Get(key, ""))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("option %s.%s: invalid integer %q", s.Name, key, v)
+	}
+	return n, nil
+}
+
+// GetList 返回 list 的所有值；option 形式时按空白分割
+func (s *uciSection) GetList(key string) []string {
+	if l, ok := s.Lists[key]; ok {
+		return l
+	}
+	return strings.Fields(s.Options[key])
+}
+
+// parseUCI 解析 UCI 配置文件 (config / option / list 语句，支持单双引号与注释)
+func parseUCI(r io.Reader) (*uciFile, error) {
+	f := &uciFile{}
+	var cur *uciSection
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		tokens, err := uciTokens(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		switch tokens[0] {
+		case "config":
+			if len(tokens) < 2 || len(tokens) > 3 {
+				return nil, fmt.Errorf("line %d: invalid config statement", lineNo)
+			}
+			cur = &uciSection{Type: tokens[1], Options: map[string]string{}, Lists: map[string][]string{}}
+			if len(tokens) == 3 {
+				cur.Name = tokens[2]
+			} else {
+				// 匿名 section
+				cur.Name = fmt.Sprintf("@%s[%d]", tokens[1], len(f.Sections))
+			}
+			f.Sections = append(f.Sections, cur)
+		case "option", "list":
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: %s outside of a config section", lineNo, tokens[0])
+			}
+			if len(tokens) < 2 || len(tokens) > 3 {
+				return nil, fmt.Errorf("line %d: invalid %s statement", lineNo, tokens[0])
+			}
+			value := ""
+			if len(tokens) == 3 {
+				value = tokens[2]
+			}
+			if tokens[0] == "option" {
+				cur.Options[tokens[1]] = value
+			} else {
+				cur.Lists[tokens[1]] = append(cur.Lists[tokens[1]], value)
+			}
+		case "package":
+			// 忽略
+		default:
+			return nil, fmt.Errorf("line %d: unknown statement %q", lineNo, tokens[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// uciTokens 按 shell 规则切分一行：支持单引号、双引号、反斜杠转义与相邻片段拼接
+func uciTokens(line string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	inToken := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '#' && !inToken:
+			return tokens, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			if inToken {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			cur.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inToken = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				cur.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inToken = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+			inToken = true
+		default:
+			cur.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, nil
+}
+
+// operatingProfile 是性能预设对应的资源参数
+type operatingProfile struct {
+	cacheSize  int
+	bufferSize int
+	poolSize   int
+}
+
+const defaultOperatingProfile = "Medium"
+
+var operatingProfiles = map[string]operatingProfile{
+	"Low":    {cacheSize: 2000, bufferSize: 8192, poolSize: 200},
+	"Medium": {cacheSize: 3000, bufferSize: 8192, poolSize: 500},
+	"High":   {cacheSize: 5000, bufferSize: 8192, poolSize: 1000},
+}
+
+// 与 init 脚本保持一致的防火墙 set 名称
+const uciFirewallSetName = "UAmask_bypass_set"
+
+// detectFirewallType 存在 fw4 时使用 nftables，否则使用 iptables
+func detectFirewallType() string {
+	if _, err := exec.LookPath("fw4"); err == nil {
+		return "nft"
+	}
+	return "ipt"
+}
+
+// loadUCIArgs 读取 UCI 配置文件并转换为等价的命令行参数，firewallOnly 时只转换重定向规则参数
+func loadUCIArgs(path string, firewallOnly bool) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+	f, err := parseUCI(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	convert := uciArgs
+	if firewallOnly {
+		convert = uciFirewallArgs
+	}
+	args, err := convert(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return args, nil
+}
+
+// uciFirewallArgs 映射 fw apply / fw remove 需要的选项：监听端口与重定向规则参数
+func uciFirewallArgs(f *uciFile) ([]string, error) {
+	main := f.Section("main")
+	var args []string
+	add := func(a ...string) { args = append(args, a...) }
+
+	add("-port", main.Get("port", "12032"))
+	add("-loglevel", main.Get("log_level", "info"))
+	add("-fw-type", detectFirewallType())
+	add("-fw-set-name", uciFirewallSetName)
+	if main.GetBool("enable_firewall_set", false) {
+		add("-fw-set")
+	}
+	if ifaces := main.GetList("iface"); len(ifaces) > 0 {
+		add("-fw-iface", strings.Join(ifaces, ","))
+	}
+	if ips := main.GetList("bypass_ips"); len(ips) > 0 {
+		add("-fw-bypass-ips", strings.Join(ips, ","))
+	}
+	if ports := main.GetList("bypass_ports"); len(ports) > 0 {
+		add("-fw-bypass-ports", strings.Join(ports, ","))
+	}
+	bypassGID, err := main.GetInt("bypass_gid", 65533)
+	if err != nil {
+		return nil, err
+	}
+	add("-fw-bypass-gid", strconv.Itoa(bypassGID))
+	if main.GetBool("proxy_host", false) {
+		add("-proxy-host")
+	}
+	return args, nil
+}
+
+// uciArgs 将 main section 的 UCI 选项映射为命令行参数
+func uciArgs(f *uciFile) ([]string, error) {
+	main := f.Section("main")
+	args, err := uciFirewallArgs(f)
+	if err != nil {
+		return nil, err
+	}
+	add := func(a ...string) { args = append(args, a...) }
+	addIfSet := func(flag, key string) {
+		if v := main.Get(key, ""); v != "" {
+			add(flag, v)
+		}
+	}
+	addInt := func(flag, key string, def int) error {
+		n, err := main.GetInt(key, def)
+		if err != nil {
+			return err
+		}
+		add(flag, strconv.Itoa(n))
+		return nil
+	}
+
+	// 基础参数 (端口、日志级别与重定向规则参数见 uciFirewallArgs)
+	add("-u", main.Get("ua", "FFF"))
+	addIfSet("-w", "whitelist")
+	add("-log", main.Get("log_file", "/tmp/UAmask/UAmask.log"))
+	drainTimeout, err := main.GetInt("drain_timeout", 10)
+	if err != nil {
+		return nil, err
+	}
+	add("-drain-timeout", fmt.Sprintf("%ds", drainTimeout))
+	if ports := main.GetList("deep_scan_ports"); len(ports) > 0 {
+		add("-deep-scan-ports", strings.Join(ports, ","))
+	}
+	addIfSet("-rules", "rules_file")
+	addIfSet("-host-map", "host_map_file")
+	if main.GetBool("ua_stats", false) {
+		add("-ua-stats")
+	}
+	if main.GetBool("keywords_ignore_case", false) {
+		add("-keywords-ignore-case")
+	}
+	if main.GetBool("keywords_whole_word", false) {
+		add("-keywords-whole-word")
+	}
+	addIfSet("-regex-engine", "regex_engine")
+	addIfSet("-client-hints", "client_hints")
+	if main.GetBool("audit", false) {
+		add("-audit")
+	}
+	if main.GetBool("learn_whitelist", false) {
+		add("-learn-whitelist")
+		if err := addInt("-learn-threshold", "learn_threshold", 3); err != nil {
+			return nil, err
+		}
+		learnTTL, err := main.GetInt("learn_ttl", 60)
+		if err != nil {
+			return nil, err
+		}
+		add("-learn-ttl", fmt.Sprintf("%dm", learnTTL))
+	}
+	if v := main.Get("regex_timeout", ""); v != "" {
+		add("-regex-timeout", v+"ms")
+	}
+
+	// 防火墙 set 参数
+	if main.GetBool("enable_firewall_set", false) {
+		if main.GetBool("Firewall_drop_on_match", false) {
+			add("-fw-drop")
+		}
+		addIfSet("-fw-ua-w", "Firewall_ua_whitelist")
+		addIfSet("-fw-sni-allow", "Firewall_sni_allow")
+		addIfSet("-fw-sni-deny", "Firewall_sni_deny")
+		addIfSet("-proto-policy", "proto_policy")
+		if main.GetBool("Firewall_ua_bypass", false) {
+			add("-fw-bypass")
+		}
+		if main.GetBool("firewall_advanced_settings", false) {
+			threshold, err := main.GetInt("firewall_nonhttp_threshold", 5)
+			if err != nil {
+				return nil, err
+			}
+			timeout, err := main.GetInt("firewall_timeout", 28800)
+			if err != nil {
+				return nil, err
+			}
+			delay, err := main.GetInt("firewall_decision_delay", 60)
+			if err != nil {
+				return nil, err
+			}
+			// 超出合理范围时恢复默认值
+			if threshold < 1 {
+				threshold = 5
+			}
+			if timeout < 60 {
+				timeout = 28800
+			}
+			if delay < 10 {
+				delay = 60
+			}
+			add("-fw-nonhttp-threshold", strconv.Itoa(threshold))
+			add("-fw-timeout", strconv.Itoa(timeout))
+			add("-fw-decision-delay", fmt.Sprintf("%ds", delay))
+		}
+	}
+
+	// 性能预设
+	profileName := main.Get("operating_profile", defaultOperatingProfile)
+	if profileName == "custom" {
+		if err := addInt("-cache-size", "cache_size", 2000); err != nil {
+			return nil, err
+		}
+		if err := addInt("-buffer-size", "buffer_size", 8192); err != nil {
+			return nil, err
+		}
+		if err := addInt("-p", "pool_size", 0); err != nil {
+			return nil, err
+		}
+		if err := addInt("-gogc", "gogc_value", 100); err != nil {
+			return nil, err
+		}
+		if err := addInt("-listeners", "listeners", 0); err != nil {
+			return nil, err
+		}
+		if main.GetBool("shard_pool", false) {
+			add("-shard-pool")
+		}
+		addIfSet("-pool-min", "pool_min")
+		addIfSet("-pool-max", "pool_max")
+		if v := main.Get("pool_wait", ""); v != "" {
+			add("-pool-wait", v+"ms")
+		}
+		addIfSet("-pool-overflow", "pool_overflow")
+	} else {
+		profile, ok := operatingProfiles[profileName]
+		if !ok {
+			logrus.Warnf("Unknown operating_profile %q, using %s", profileName, defaultOperatingProfile)
+			profile = operatingProfiles[defaultOperatingProfile]
+		}
+		add("-cache-size", strconv.Itoa(profile.cacheSize))
+		add("-buffer-size", strconv.Itoa(profile.bufferSize))
+		add("-p", strconv.Itoa(profile.poolSize))
+	}
+
+	// 匹配规则
+	switch mode := main.Get("match_mode", "keywords"); mode {
+	case "keywords":
+		add("-keywords", main.Get("keywords", "iPhone,iPad,Android,Macintosh,Windows"))
+		addIfSet("-keywords-file", "keywords_file")
+	case "regex":
+		add("-enable-regex", "-r", main.Get("ua_regex", "(iPhone|iPad|Android|Macintosh|Windows|Linux)"))
+		if main.Get("replace_method", "full") == "partial" {
+			add("-s")
+		}
+	case "all":
+		add("-force")
+	default:
+		return nil, fmt.Errorf("option main.match_mode: unknown mode %q", mode)
+	}
+
+	return args, nil
+}
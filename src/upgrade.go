@@ -0,0 +1,241 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 平滑升级：
+// 最初由 procd 启动的进程收到 SIGUSR2 后启动新进程并交出监听器，排空已有连接后不再处理连接，
+// 改为监督进程 (procd 跟踪的仍是它)：转发信号，之后的 SIGUSR2 由它启动下一个新进程并让上一个退出。
+// 因此任意时刻最多只有监督进程、当前进程与一个正在排空的进程；监督进程被 SIGKILL 时子进程收到 SIGTERM。
+const (
+	envListenFDs  = "UAMASK_LISTEN_FDS" // 继承的监听器数量，fd 从 3 开始 (同 systemd socket activation)
+	envReadyFD    = "UAMASK_READY_FD"   // 新进程开始接受连接后写入该 fd 通知旧进程
+	envSupervised = "UAMASK_SUPERVISED" // 进程由监督进程启动，升级请求交给监督进程处理
+
+	// 监督进程发给被替换进程的信号：排空已有连接后退出，不删除新进程共用的 socket 文件
+	signalRetire = syscall.SIGUSR1
+
+	upgradeReadyTimeout = 30 * time.Second
+	listenFDStart       = 3
+)
+
+// inheritedListeners 返回从旧进程继承的监听器
+// 兼容 systemd socket activation 的 LISTEN_FDS / LISTEN_PID
+func inheritedListeners() ([]*net.TCPListener, error) {
+	count := os.Getenv(envListenFDs)
+	if count == "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		count = os.Getenv("LISTEN_FDS")
+	}
+	// 不再传递给之后启动的进程
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	if count == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid inherited listener count: %q", count)
+	}
+	listeners := make([]*net.TCPListener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFDStart+i), fmt.Sprintf("listener-%d", i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d: %w", listenFDStart+i, err)
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, fmt.Errorf("inherited fd %d is not a TCP listener", listenFDStart+i)
+		}
+		listeners = append(listeners, tl)
+	}
+	return listeners, nil
+}
+
+// isSupervised 判断当前进程是否由监督进程启动
+func isSupervised() bool {
+	return os.Getenv(envSupervised) != ""
+}
+
+// listenerFiles 复制监听器的 fd，监督进程持有这些 fd 用于之后的升级
+func listenerFiles(listeners []*net.TCPListener) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(listeners))
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("dup listener: %w", err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// notifyReady 通知旧进程 (如有) 新进程已开始接受连接
+func notifyReady() {
+	v := os.Getenv(envReadyFD)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// spawnUpgrade 以相同参数启动磁盘上的二进制 (可能已被新版本替换)，
+// 通过继承 fd 交出监听器 (listenerFiles 的结果，调用方负责关闭)，等待新进程就绪后返回
+// 必须在主 goroutine 中调用：Pdeathsig 绑定到执行 fork 的线程
+func spawnUpgrade(listeners []*os.File) (*exec.Cmd, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot locate executable: %w", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListenFDs+"=") && !strings.HasPrefix(kv, envReadyFD+"=") && !strings.HasPrefix(kv, envSupervised+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		fmt.Sprintf("%s=%d", envListenFDs, len(listeners)),
+		fmt.Sprintf("%s=%d", envReadyFD, listenFDStart+len(listeners)),
+		envSupervised+"=1",
+	)
+
+	// 锁定后不再解锁，主 goroutine 所在线程与进程同生命周期，Pdeathsig 不会因线程退出而误触发
+	runtime.LockOSThread()
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File{}, listeners...), readyW)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return nil, fmt.Errorf("start %s: %w", path, err)
+	}
+	// 关闭父进程持有的写端，新进程异常退出时读端会收到 EOF
+	readyW.Close()
+
+	readyR.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	buf := make([]byte, 1)
+	if _, err := readyR.Read(buf); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("new process did not become ready within %s", upgradeReadyTimeout)
+		}
+		return nil, fmt.Errorf("new process exited before becoming ready")
+	}
+	return cmd, nil
+}
+
+// superviseChild 交接完成后作为监督进程运行，直到所有子进程退出，返回当前进程的退出码
+// procd / systemd 跟踪的仍是最初启动的进程：收到的信号转发给当前进程，
+// SIGUSR2 则以持有的监听器 fd 启动新进程，就绪后让上一个进程排空并退出
+func superviseChild(cmd *exec.Cmd, listeners []*os.File, sigChan <-chan os.Signal) int {
+	type childExit struct {
+		cmd *exec.Cmd
+		err error
+	}
+	exits := make(chan childExit, 1)
+	running := 0
+	wait := func(c *exec.Cmd) {
+		running++
+		go func() {
+			exits <- childExit{c, c.Wait()}
+		}()
+	}
+
+	current := cmd
+	wait(current)
+	exitCode := 0
+	for running > 0 {
+		select {
+		case sig := <-sigChan:
+			if current == nil {
+				continue
+			}
+			switch sig {
+			case signalRetire:
+				continue
+			case syscall.SIGUSR2:
+			default:
+				logrus.Infof("[Upgrade] Forwarding %s to process %d", sig, current.Process.Pid)
+				current.Process.Signal(sig)
+				continue
+			}
+			next, err := spawnUpgrade(listeners)
+			if err != nil {
+				logrus.Errorf("[Upgrade] Upgrade aborted, process %d keeps serving: %v", current.Process.Pid, err)
+				continue
+			}
+			logrus.Infof("[Upgrade] Process %d is accepting connections, retiring process %d", next.Process.Pid, current.Process.Pid)
+			current.Process.Signal(signalRetire)
+			current = next
+			wait(current)
+		case e := <-exits:
+			running--
+			if e.cmd != current {
+				logrus.Infof("[Upgrade] Retired process %d exited", e.cmd.Process.Pid)
+				continue
+			}
+			// 当前进程退出后服务随之结束，等待仍在排空的进程
+			current = nil
+			exitCode = exitStatus(e.err)
+		}
+	}
+	return exitCode
+}
+
+// exitStatus 将 cmd.Wait 的结果转换为退出码
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			return status.ExitStatus()
+		}
+		return 1
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
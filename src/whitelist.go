@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UA 白名单条目格式 (-w，逗号分隔)：
+//
+//	exact:<UA>     与 UA 完全相同 (不带前缀时的默认行为)
+//	prefix:<文本>  UA 以文本开头，如 prefix:Mozilla/5.0 (PlayStation
+//	contains:<文本> UA 包含文本
+//	glob:<模式>    整个 UA 匹配通配符，* 匹配任意字符串，? 匹配单个字符
+//	regex:<正则>   UA 匹配正则 (引擎由 -regex-engine 指定)
+//
+// 以上均区分大小写，regex 可使用 (?i)
+var whitelistKinds = []string{"exact", "prefix", "contains", "glob", "regex"}
+
+// uaWhitelist 是编译后的 UA 白名单
+type uaWhitelist struct {
+	exact    map[string]bool
+	prefixes []string
+	contains *keywordMatcher
+	patterns []uaPattern // glob 与 regex
+	sources  []string    // patterns 对应的原始条目，用于日志
+}
+
+// newUAWhitelist 按条目前缀编译白名单，没有条目时返回 nil
+func newUAWhitelist(entries []string, compiler patternCompiler) (*uaWhitelist, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	w := &uaWhitelist{exact: make(map[string]bool)}
+	var contains []string
+	for _, entry := range entries {
+		kind, value := "exact", entry
+		if k, v, ok := strings.Cut(entry, ":"); ok && isWhitelistKind(k) {
+			kind, value = k, v
+		}
+		if value == "" {
+			return nil, fmt.Errorf("empty whitelist entry: %q", entry)
+		}
+		switch kind {
+		case "exact":
+			w.exact[value] = true
+		case "prefix":
+			w.prefixes = append(w.prefixes, value)
+		case "contains":
+			contains = append(contains, value)
+		case "glob", "regex":
+			pattern := value
+			if kind == "glob" {
+				pattern = globToRegexp(value)
+			}
+			re, err := compiler.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid whitelist entry %q: %w", entry, err)
+			}
+			w.patterns = append(w.patterns, re)
+			w.sources = append(w.sources, entry)
+		}
+	}
+	w.contains = newKeywordMatcher(contains, false, false)
+	return w, nil
+}
+
+func isWhitelistKind(kind string) bool {
+	for _, k := range whitelistKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp 将通配符转换为锚定的正则
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Match 返回命中的白名单条目，正则匹配超时时返回错误
+func (w *uaWhitelist) Match(ua string) (string, bool, error) {
+	if w == nil {
+		return "", false, nil
+	}
+	if w.exact[ua] {
+		return "exact", true, nil
+	}
+	for _, p := range w.prefixes {
+		if strings.HasPrefix(ua, p) {
+			return "prefix:" + p, true, nil
+		}
+	}
+	if kw, ok := w.contains.Match(ua); ok {
+		return "contains:" + kw, true, nil
+	}
+	for i, re := range w.patterns {
+		ok, err := re.MatchString(ua)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			return w.sources[i], true, nil
+		}
+	}
+	return "", false, nil
+}